@@ -0,0 +1,120 @@
+package corerunner
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// Время ожидания занятого предпочтительного воркера по умолчанию.
+	DefaultAffinityWait = 50 * time.Millisecond
+	// Количество точек воркера на кольце хэшей. Чем больше точек, тем
+	// равномернее ключи распределяются между воркерами.
+	affinityReplicas = 64
+)
+
+type affinityKey struct{}
+
+// WithAffinity возвращает контекст, задачи с которым по возможности
+// выполняются одним и тем же воркером пула. Воркер выбирается по ключу key
+// консистентным хэшированием, поэтому при добавлении или удалении воркера
+// меняется воркер только у небольшой части ключей. Это позволяет процессам
+// держать в памяти данные, относящиеся к ключу, например, настройки клиента
+// или скомпилированные шаблоны.
+//
+// Если предпочтительный воркер перезапускается или не берет задачу в течение
+// Pool.AffinityWait, то задача попадает в общую очередь и выполняется любым
+// свободным воркером. Пока задача ждет предпочтительного воркера, она
+// учитывается в длине очереди и ограничениях Pool.MaxQueue и
+// Pool.MaxQueueWait. Не действует в пулах с дорожками (Pool.Lanes) и для
+// внешних воркеров.
+func WithAffinity(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, affinityKey{}, key)
+}
+
+// Кольцо хэшей воркеров пула.
+type hashRing struct {
+	points []uint64
+	owners map[uint64]*Worker
+}
+
+// newHashRing строит кольцо хэшей из воркеров wrks.
+func newHashRing(wrks []*Worker) *hashRing {
+	r := &hashRing{owners: make(map[uint64]*Worker)}
+	for _, wrk := range wrks {
+		for i := 0; i < affinityReplicas; i++ {
+			h := hashKey(strconv.FormatUint(wrk.id, 10) + "-" + strconv.Itoa(i))
+			r.points = append(r.points, h)
+			r.owners[h] = wrk
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+	return r
+}
+
+// get возвращает воркер для ключа key или nil, если кольцо пусто.
+func (r *hashRing) get(key string) *Worker {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// affine возвращает предпочтительный воркер для задачи с контекстом ctx или
+// nil, если у задачи нет ключа привязки.
+func (p *Pool) affine(ctx context.Context) *Worker {
+	if ctx == nil || p.sched != nil {
+		return nil
+	}
+	key, _ := ctx.Value(affinityKey{}).(string)
+	if key == "" {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ring == nil {
+		p.ring = newHashRing(p.pool)
+	}
+	return p.ring.get(key)
+}
+
+// sendAffine передает задачу job предпочтительному воркеру wrk. Возвращает
+// false, если воркер перезапускается, не взял задачу за AffinityWait, задачу
+// отменили или пул останавливается.
+func (p *Pool) sendAffine(wrk *Worker, job WorkerJob) bool {
+	if s := wrk.State(); s != WorkerIdle && s != WorkerBusy {
+		return false
+	}
+	wait := p.AffinityWait
+	if wait <= 0 {
+		wait = DefaultAffinityWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case wrk.affine <- job:
+		return true
+	case <-timer.C:
+	case <-job.state.taken:
+	case <-p.done:
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package corerunner
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	var wrks []*Worker
+	for i := 1; i <= 4; i++ {
+		wrks = append(wrks, &Worker{id: uint64(i)})
+	}
+	before := newHashRing(wrks)
+	after := newHashRing(append(wrks, &Worker{id: 5}))
+	counts := map[uint64]int{}
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := "tenant-" + strconv.Itoa(i)
+		wrk := before.get(key)
+		if wrk != before.get(key) {
+			t.Fatalf("key %q is routed to different workers", key)
+		}
+		counts[wrk.id]++
+		if after.get(key) != wrk {
+			moved++
+		}
+	}
+	for id, n := range counts {
+		if n < 150 {
+			t.Fatalf("worker %d got only %d of 1000 keys: %v", id, n, counts)
+		}
+	}
+	// В среднем к новому воркеру переходит пятая часть ключей.
+	if moved < 100 || moved > 300 {
+		t.Fatalf("%d of 1000 keys moved after adding a worker", moved)
+	}
+}
+
+func TestAffineWait(t *testing.T) {
+	p := &Pool{MaxQueue: 1, AffinityWait: 10 * time.Second}
+	if err := p.Start(nil, 0, nil); err != nil {
+		t.Fatalf("could not start pool: %s", err)
+	}
+	// Предпочтительный воркер занят и не берет задачу.
+	wrk := NewWorker(p.queue)
+	wrk.state.Store(int32(WorkerBusy))
+	p.mu.Lock()
+	p.pool = []*Worker{wrk}
+	p.mu.Unlock()
+	affine := make(chan chan WorkerResult)
+	go func() {
+		affine <- p.SendContext(WithAffinity(context.Background(), "key"), nil, time.Second)
+	}()
+	for i := 0; p.queueLength() == 0; i++ {
+		if i == 100 {
+			t.Fatal("affine job is not counted in queue length")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if res := <-p.Send(nil, time.Second); !errors.Is(res.Err, ErrQueueFull) {
+		t.Fatalf("job beyond MaxQueue got %v", res.Err)
+	}
+	p.mu.Lock()
+	p.pool = []*Worker{}
+	p.ring = nil
+	p.mu.Unlock()
+	// Остановка не ждет окончания AffinityWait.
+	start := time.Now()
+	p.Stop()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("stop took %s", d)
+	}
+	if res := <-<-affine; !errors.Is(res.Err, ErrPoolStopped) {
+		t.Fatalf("affine job got %v", res.Err)
+	}
+}
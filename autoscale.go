@@ -0,0 +1,94 @@
+package corerunner
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// Время ожидания задачи в очереди по умолчанию, при превышении
+	// которого пул добавляет воркер.
+	DefaultScaleUpWait = 100 * time.Millisecond
+	// Время простоя по умолчанию, после которого лишний воркер
+	// останавливается.
+	DefaultScaleDownIdle = 30 * time.Second
+	// Период принятия решений о масштабировании по умолчанию.
+	DefaultScaleInterval = time.Second
+	// Количество проверок подряд с высокой нагрузкой, после которого
+	// добавляется воркер. Нужно, чтобы не реагировать на единичные всплески.
+	scaleUpChecks = 2
+)
+
+// autoscale периодически проверяет нагрузку на пул и меняет количество
+// воркеров в пределах от MinWorkers (или n) до MaxWorkers. Работает до
+// закрытия done.
+func (p *Pool) autoscale(done chan struct{}, n int) {
+	minWrks := p.MinWorkers
+	if minWrks <= 0 {
+		minWrks = n
+	}
+	upQueue := p.ScaleUpQueue
+	if upQueue <= 0 {
+		upQueue = 1
+	}
+	upWait := p.ScaleUpWait
+	if upWait <= 0 {
+		upWait = DefaultScaleUpWait
+	}
+	downIdle := p.ScaleDownIdle
+	if downIdle <= 0 {
+		downIdle = DefaultScaleDownIdle
+	}
+	interval := p.ScaleInterval
+	if interval <= 0 {
+		interval = DefaultScaleInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pressure := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		depth := p.queueLength()
+		wait := time.Duration(p.maxWait.Swap(0))
+		wrks := p.workers()
+		if depth >= upQueue || wait >= upWait {
+			pressure++
+		} else {
+			pressure = 0
+		}
+
+		if pressure >= scaleUpChecks && len(wrks) < p.MaxWorkers {
+			pressure = 0
+			log.Printf(
+				"pool: scaling up to %d workers (queue depth %d, max wait %s)",
+				len(wrks)+1, depth, wait,
+			)
+			if err := p.spawn(); err != nil {
+				log.Printf("pool: could not scale up: %s", err)
+			}
+			continue
+		}
+
+		if pressure > 0 || len(wrks) <= minWrks {
+			continue
+		}
+		// Останавливаем не более одного воркера за проверку, чтобы
+		// плавно снижать количество процессов.
+		for _, wrk := range wrks {
+			idle := wrk.idle()
+			if idle < downIdle {
+				continue
+			}
+			log.Printf(
+				"pool: scaling down to %d workers (PID %d idle for %s)",
+				len(wrks)-1, wrk.Pid(), idle.Round(time.Millisecond),
+			)
+			p.remove(wrk)
+			break
+		}
+	}
+}
@@ -23,6 +23,7 @@
 package corerunner
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 )
@@ -35,6 +36,9 @@ type HTTPRequest struct {
 	Body    []byte
 	Files   map[string]*File
 	Form    map[string]string
+	// Путь к временному файлу с телом запроса, если тело слишком большое
+	// для передачи в сообщении. Body в этом случае пуст.
+	BodyPath string
 }
 
 // Write сериализует HTTP-запрос с записью в указанный io.Writer.
@@ -59,7 +63,11 @@ func (hr *HTTPRequest) Write(w io.Writer) error {
 	if err != nil {
 		return err
 	}
-	return writeStringMap(w, hr.Form)
+	err = writeStringMap(w, hr.Form)
+	if err != nil {
+		return err
+	}
+	return writeString(w, hr.BodyPath)
 }
 
 // Parse считывает HTTP-запрос из указанного io.Reader.
@@ -94,6 +102,11 @@ func (hr *HTTPRequest) Parse(r io.Reader) error {
 		return err
 	}
 	hr.Form = form
+	bodyPath, err := parseString(r)
+	if err != nil {
+		return err
+	}
+	hr.BodyPath = bodyPath
 	return nil
 }
 
@@ -238,11 +251,26 @@ func (jr *JobResponse) Parse(r io.Reader) error {
 	return nil
 }
 
+// Сериализация рассчитана на *bytes.Buffer (см. GetBuffer): для него поля
+// пишутся и читаются без промежуточных аллокаций. Остальные io.Writer и
+// io.Reader тоже поддерживаются.
+
 func writeString(w io.Writer, val string) error {
+	if buf, ok := w.(*bytes.Buffer); ok {
+		writeUint64(buf, uint64(len(val)))
+		buf.WriteString(val)
+		return nil
+	}
 	return writeBytes(w, []byte(val))
 }
 
 func parseString(r io.Reader) (string, error) {
+	if buf, ok := r.(*bytes.Buffer); ok {
+		// Строка копируется из буфера один раз, без промежуточного
+		// []byte.
+		data, err := nextBytes(buf)
+		return string(data), err
+	}
 	res, err := parseBytes(r)
 	if err != nil {
 		return "", err
@@ -251,14 +279,37 @@ func parseString(r io.Reader) (string, error) {
 }
 
 func writeUint64(w io.Writer, val uint64) error {
-	return binary.Write(w, binary.LittleEndian, val)
+	if buf, ok := w.(*bytes.Buffer); ok {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], val)
+		buf.Write(b[:])
+		return nil
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, val)
+	_, err := w.Write(b)
+	return err
 }
 
 func parseUint64(r io.Reader) (uint64, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(b), nil
+	}
 	var res uint64
-	err := binary.Read(r, binary.LittleEndian, &res)
-	if err != nil {
-		return 0, err
+	for i := 0; i < 8; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		res |= uint64(b) << (8 * i)
 	}
 	return res, nil
 }
@@ -268,23 +319,44 @@ func writeBytes(w io.Writer, val []byte) error {
 	if err != nil {
 		return err
 	}
-	return binary.Write(w, binary.LittleEndian, val)
+	_, err = w.Write(val)
+	return err
 }
 
 func parseBytes(r io.Reader) ([]byte, error) {
-	var l uint64
-	err := binary.Read(r, binary.LittleEndian, &l)
+	if buf, ok := r.(*bytes.Buffer); ok {
+		data, err := nextBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Буфер может быть переиспользован, поэтому данные копируются.
+		return append([]byte{}, data...), nil
+	}
+	l, err := parseUint64(r)
 	if err != nil {
 		return nil, err
 	}
 	res := make([]byte, l)
-	err = binary.Read(r, binary.LittleEndian, &res)
-	if err != nil {
+	if _, err = io.ReadFull(r, res); err != nil {
 		return nil, err
 	}
 	return res, nil
 }
 
+// nextBytes читает длину поля и возвращает его данные из буфера buf без
+// копирования.
+func nextBytes(buf *bytes.Buffer) ([]byte, error) {
+	l, err := parseUint64(buf)
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(buf.Len()) {
+		buf.Reset()
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Next(int(l)), nil
+}
+
 func writeStringMap(w io.Writer, val map[string]string) error {
 	err := writeUint64(w, uint64(len(val)))
 	if err != nil {
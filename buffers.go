@@ -0,0 +1,36 @@
+package corerunner
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Максимальный размер буфера (в байтах), который возвращается в пул. Буферы
+// редких больших запросов отдаются сборщику мусора, чтобы не удерживать
+// память.
+const maxPooledBuffer = 1 << 20
+
+// Буферы для сериализации сообщений воркерам.
+var bufPool = sync.Pool{
+	New: func() any {
+		buf := &bytes.Buffer{}
+		buf.Grow(4096)
+		return buf
+	},
+}
+
+// GetBuffer возвращает пустой буфер из пула. Буфер нужно вернуть через
+// PutBuffer, когда его содержимое больше не используется, в том числе
+// воркером, которому оно передано в Send.
+func GetBuffer() *bytes.Buffer {
+	return bufPool.Get().(*bytes.Buffer)
+}
+
+// PutBuffer возвращает буфер buf в пул.
+func PutBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufPool.Put(buf)
+}
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"net/rpc/jsonrpc"
 	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	runner "github.com/ruvents/corerunner"
@@ -24,10 +33,18 @@ import (
 var wsPool *websocket.Pool
 var jobsPool *jobs.Pool
 
+// Все запущенные пулы воркеров, перезагружаемые по SIGHUP.
+var wrkPools []*runner.Pool
+
+// Сервисы Go, которые PHP может вызывать во время обработки запроса через
+// Dispatcher::call().
+var services runner.Services
+
 // Пример приложения, собранного из библиотеки corerunner.
 func main() {
 	httpExe := flag.String("p", "", "Run specified PHP-file for HTTP handling. HTTP workers will not be started if flag is omitted.")
 	wrksNum := flag.Int("n", runtime.NumCPU(), "Number of HTTP-workers to start")
+	maxWrks := flag.Int("max-workers", 0, "Automatically scale HTTP-workers up to specified number under load. Default is 0 (no autoscaling).")
 	addr := flag.String("l", "127.0.0.1:3000", "Address HTTP-server will listen to")
 	static := flag.String("s", "", "Directory to serve statically")
 	maxAge := flag.Int("ma", 0, "Max-age for statically served files (in seconds). Default is 0.")
@@ -35,46 +52,225 @@ func main() {
 	jobsExe := flag.String("j", "", "Run specified PHP-file for jobs handling. Jobs will not be started if flag is omitted.")
 	rpcAddr := flag.String("rpc", "", "Start RPC handler on specified address")
 	redisAddr := flag.String("r", "", "Start Redis listener to specified address")
+	maxJobs := flag.Int("max-jobs", 0, "Restart worker after it handled specified number of jobs. Default is 0 (unlimited).")
+	maxUptime := flag.Duration("max-uptime", 0, "Restart worker after specified uptime, e.g. \"1h\". Default is 0 (unlimited).")
+	memSoft := flag.Uint64("mem-soft", 0, "Gracefully restart worker after its RSS exceeds specified amount of megabytes. Default is 0 (unlimited).")
+	memHard := flag.Uint64("mem-hard", 0, "Kill worker as soon as its RSS exceeds specified amount of megabytes. Default is 0 (unlimited).")
+	maxQueue := flag.Int("max-queue", 0, "Respond with 503 when more than specified number of HTTP-requests wait for a worker. Default is 0 (512 per worker, no 503).")
+	maxQueueWait := flag.Duration("max-queue-wait", 0, "Respond with 503 when HTTP-request waits for a worker longer than specified duration. Default is 0 (unlimited).")
+	appName := flag.String("app", "", "Refuse workers which report a different app name in their hello")
+	appBuild := flag.String("build", "", "Refuse workers which report a different build ID in their hello, e.g. during a rolling deploy")
+	buildFile := flag.String("build-file", "", "Read expected build ID from specified file at start and on every reload instead of -build, e.g. written by a deploy script before SIGHUP")
+	requireJobs := flag.String("require-jobs", "", "Refuse job workers which do not handle all of specified comma-separated job names")
+	timeoutGrace := flag.Duration("timeout-grace", 0, "Time a worker has to respond or exit after it received -timeout-signal on job timeout before it is killed. Default is 0 (timed out workers are killed immediately).")
+	timeoutSignal := flag.String("timeout-signal", "TERM", "Signal sent to a worker on job timeout: TERM or ALRM")
+	killCancelled := flag.Bool("kill-cancelled", false, "Kill HTTP-worker when client disconnects before response is ready")
+	bodySpill := flag.Int64("body-spill", 0, "Pass HTTP-request bodies larger than specified amount of megabytes to PHP as a temporary file path in HTTPRequest::$bodyPath instead of $body. Default is 0 (bodies are always passed in $body).")
+	maxMessage := flag.Int("max-message", runner.DefaultMaxMessageSize>>20, "Restart worker which sends a message larger than specified amount of megabytes")
+	transport := flag.String("transport", "stdio", "Transport for communication with spawned workers: stdio, fd, unix or tcp")
+	workersListen := flag.String("workers-listen", "", "Accept external HTTP-workers on specified address, e.g. \"unix:///run/corerunner.sock\" or \"tcp://127.0.0.1:7000\". Workers connecting from non-loopback addresses are accepted only if CORERUNNER_TOKEN environment variable is set and they send the same token.")
+	healthPath := flag.String("health", "", "Serve workers health status on specified path, e.g. \"/health\"")
+	readyPath := flag.String("ready", "", "Serve workers readiness status on specified path, e.g. \"/ready\"")
+	pingInterval := flag.Duration("ping-interval", 0, "Ping workers idle for specified duration and restart those which do not respond. Default is 0 (no pings).")
+	pingTimeout := flag.Duration("ping-timeout", runner.DefaultPingTimeout, "Time to wait for worker response to ping")
+	logFormat := flag.String("log-format", "text", "Format of worker logs: text or json")
+	logFile := flag.String("log-file", "", "Write worker logs to specified file instead of stderr")
+	logMaxLine := flag.Int("log-max-line", runner.DefaultLogMaxLine, "Truncate worker log records longer than specified number of bytes")
+	runUser := flag.String("user", "", "Run workers as specified user (name or UID)")
+	runGroup := flag.String("group", "", "Run workers with specified group (name or GID). Default is primary group of -user.")
+	rlimitAS := flag.Uint64("rlimit-as", 0, "Limit virtual memory of each worker to specified amount of megabytes. Default is 0 (unlimited).")
+	rlimitNofile := flag.Uint64("rlimit-nofile", 0, "Limit number of files opened by each worker. Default is 0 (unlimited).")
+	rlimitCPU := flag.Duration("rlimit-cpu", 0, "Kill worker after it used specified amount of CPU time, e.g. \"10m\". Default is 0 (unlimited).")
+	cgroup := flag.String("cgroup", "", "Put each pool of workers into its own cgroup v2 under specified directory, e.g. \"/sys/fs/cgroup/corerunner\"")
+	cgroupMem := flag.Uint64("cgroup-memory", 0, "Limit memory of all workers of a pool to specified amount of megabytes (requires -cgroup). Default is 0 (unlimited).")
+	cgroupCPUs := flag.Float64("cgroup-cpus", 0, "Limit CPU usage of all workers of a pool to specified number of CPUs (requires -cgroup). Default is 0 (unlimited).")
+	lanes := flag.String("lanes", "", "Split HTTP-workers queue into weighted lanes \"name:weight[:max-queue[:max-workers]]\" separated by commas, e.g. \"default:1,critical:4:0:2\". The first lane is used by default.")
+	laneHeader := flag.String("lane-header", "X-Lane", "Request header with lane name set by a trusted proxy (requires -lanes)")
+	affinityHeader := flag.String("affinity-header", "", "Request header, e.g. \"X-Tenant\", by which requests are routed to the same HTTP-worker to reuse its warm caches")
+	affinityWait := flag.Duration("affinity-wait", runner.DefaultAffinityWait, "Time a request waits for its busy HTTP-worker before going to any free one (requires -affinity-header)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Time to finish running requests and jobs on SIGTERM or SIGINT before killing workers")
+	watchFiles := flag.Bool("watch", false, "Reload workers when PHP files next to -p and -j scripts change. Intended for development.")
 	flag.Parse()
 
 	env := os.Environ()
+	// Слушающие сокеты, закрываемые при остановке сервера.
+	var listeners []net.Listener
+	registerServices()
+	wrkTransport, err := parseTransport(*transport)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logSink, err := openLogSink(*logFormat, *logFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	timeoutSig, err := parseSignal(*timeoutSignal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *buildFile != "" {
+		if *appBuild, err = readBuild(*buildFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Перезагружает пулы, ожидая от новых воркеров сборку из -build-file.
+	reload := func() {
+		if *buildFile == "" {
+			reloadPools(nil)
+			return
+		}
+		build, err := readBuild(*buildFile)
+		if err != nil {
+			log.Printf("reload error, keeping previous workers: %s", err)
+			return
+		}
+		reloadPools(&build)
+	}
+	httpLanes, err := parseLanes(*lanes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uid, gid, err := lookupUser(*runUser, *runGroup)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Ограничения одинаковы для всех пулов, отличается только cgroup.
+	isolation := func(pool string) runner.Isolation {
+		iso := runner.Isolation{
+			UID:             uid,
+			GID:             gid,
+			MaxAddressSpace: *rlimitAS << 20,
+			MaxOpenFiles:    *rlimitNofile,
+			MaxCPUTime:      *rlimitCPU,
+		}
+		if *cgroup != "" {
+			iso.Cgroup = filepath.Join(*cgroup, pool)
+			iso.CgroupMemoryMax = *cgroupMem << 20
+			iso.CgroupCPUMax = *cgroupCPUs
+		}
+		return iso
+	}
 	// RPC
 	if *rpcAddr != "" {
 		if *jobsExe != "" {
 			mustExist(*jobsExe)
-			var wrks runner.Pool
+			wrks := runner.Pool{
+				Name:            "jobs",
+				App:             *appName,
+				Build:           *appBuild,
+				RequiredJobs:    splitList(*requireJobs),
+				LogSink:         logSink,
+				LogMaxLine:      *logMaxLine,
+				Isolation:       isolation("jobs"),
+				MaxJobs:         *maxJobs,
+				MaxUptime:       *maxUptime,
+				MemorySoftLimit: *memSoft << 20,
+				MemoryHardLimit: *memHard << 20,
+				PingInterval:    *pingInterval,
+				PingTimeout:     *pingTimeout,
+				TimeoutGrace:    *timeoutGrace,
+				TimeoutSignal:   timeoutSig,
+				Services:        &services,
+				Transport:       wrkTransport,
+				MaxMessageSize:  *maxMessage << 20,
+			}
 			// Jobs
 			if err := wrks.Start([]string{"php", *jobsExe}, 2, env); err != nil {
 				log.Fatal("error starting: ", err)
 			}
-			defer wrks.Stop()
+			wrkPools = append(wrkPools, &wrks)
 			jobsPool = jobs.NewPool(&wrks)
 		}
-		go startRPC(*rpcAddr)
+		l, err := net.Listen("tcp", *rpcAddr)
+		if err != nil {
+			log.Fatal("RPC listen error:", err)
+		}
+		listeners = append(listeners, l)
+		go serveRPC(l)
 	}
 
 	// HTTP
 	if *httpExe != "" && *wrksNum > 0 {
 		mustExist(*httpExe)
-		wrks := runner.Pool{}
+		wrks := runner.Pool{
+			Name:            "http",
+			App:             *appName,
+			Build:           *appBuild,
+			LogSink:         logSink,
+			LogMaxLine:      *logMaxLine,
+			Isolation:       isolation("http"),
+			MaxJobs:         *maxJobs,
+			MaxUptime:       *maxUptime,
+			MemorySoftLimit: *memSoft << 20,
+			MemoryHardLimit: *memHard << 20,
+			PingInterval:    *pingInterval,
+			PingTimeout:     *pingTimeout,
+			TimeoutGrace:    *timeoutGrace,
+			TimeoutSignal:   timeoutSig,
+			MaxWorkers:      *maxWrks,
+			MaxQueue:        *maxQueue,
+			MaxQueueWait:    *maxQueueWait,
+			Lanes:           httpLanes,
+			AffinityWait:    *affinityWait,
+			Services:        &services,
+			Transport:       wrkTransport,
+			MaxMessageSize:  *maxMessage << 20,
+		}
+		if *killCancelled {
+			wrks.CancelPolicy = runner.CancelKill
+		}
 		if err := wrks.Start([]string{"php", *httpExe}, *wrksNum, env); err != nil {
 			log.Fatal("error starting: ", err)
 		}
-		defer wrks.Stop()
+		wrkPools = append(wrkPools, &wrks)
+		if *workersListen != "" {
+			network, address, err := runner.ParseListenAddr(*workersListen)
+			if err != nil {
+				log.Fatal(err)
+			}
+			l, err := net.Listen(network, address)
+			if err != nil {
+				log.Fatal("workers listen error: ", err)
+			}
+			listeners = append(listeners, l)
+			wrks.WorkerToken = os.Getenv(runner.WorkerTokenEnv)
+			go wrks.Serve(l)
+			log.Printf("http: accepting external workers on %s", *workersListen)
+			if wrks.WorkerToken == "" {
+				log.Printf(
+					"http: %s is not set, accepting only local external workers",
+					runner.WorkerTokenEnv,
+				)
+			}
+		}
 		// Простая цепочка обработчиков: сначала пытаемся отдать
 		// статический файл. При его отсутствии передаем запрос
 		// PHP-приложению.
 		handler := rhttp.NewStaticHandler(*static, *maxAge, *cors)
 		timeout := time.Second * 30
-		handler.Next(rhttp.NewWorkerHandler(
+		wrkHandler := rhttp.NewWorkerHandler(
 			&wrks, *cors, timeout, uint(*wrksNum)*2,
-		))
+		)
+		wrkHandler.BodySpillThreshold = *bodySpill << 20
+		if len(httpLanes) > 0 {
+			header := *laneHeader
+			wrkHandler.Lane = func(r *http.Request) string {
+				return r.Header.Get(header)
+			}
+		}
+		if *affinityHeader != "" {
+			header := *affinityHeader
+			wrkHandler.Affinity = func(r *http.Request) string {
+				return r.Header.Get(header)
+			}
+		}
+		handler.Next(wrkHandler)
 		http.Handle("/", handler)
 	}
 
 	// Websocket
 	wsPool = websocket.NewPool()
-	http.Handle("/ws", websocket.NewHandler(
+	wsHandler := websocket.NewHandler(
 		func(msg []byte, conn *websocket.Connection) []byte {
 			cmd := struct {
 				Command string
@@ -92,7 +288,8 @@ func main() {
 		func(conn *websocket.Connection) {
 			wsPool.Remove(conn)
 		},
-	))
+	)
+	http.Handle("/ws", wsHandler)
 
 	if redisAddr != nil && *redisAddr != "" {
 		addr := *redisAddr
@@ -135,6 +332,23 @@ func main() {
 		log.Println("redis: listening to " + addr)
 	}
 
+	if *healthPath != "" {
+		http.Handle(*healthPath, rhttp.NewHealthHandler(wrkPools...))
+	}
+	if *readyPath != "" {
+		http.Handle(*readyPath, rhttp.NewReadinessHandler(wrkPools...))
+	}
+
+	go reloadOnSignal(reload)
+	if *watchFiles {
+		dirs := watchDirs(*httpExe, *jobsExe)
+		go watch(dirs, func() {
+			log.Println("watch: PHP files changed, reloading workers")
+			reload()
+		})
+		log.Printf("watch: watching PHP files in %s", strings.Join(dirs, ", "))
+	}
+
 	if *jobsExe != "" {
 		log.Println("jobs: waiting for requests")
 	}
@@ -151,20 +365,76 @@ func main() {
 		log.Printf(`http: serving PHP application "%s"`, *httpExe)
 	}
 	log.Println("http: listening on " + *addr)
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	srv := &http.Server{Addr: *addr}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	log.Printf("%s received, shutting down", <-sig)
+	// Повторный сигнал завершает процесс сразу.
+	signal.Stop(sig)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	shutdown(ctx, srv, wsHandler, listeners)
+	log.Println("shutdown complete")
 }
 
-func startRPC(addr string) {
-	l, e := net.Listen("tcp", addr)
-	if e != nil {
-		log.Fatal("RPC listen error:", e)
+// shutdown штатно останавливает сервер: перестает принимать соединения,
+// дожидается ответов на текущие HTTP-запросы, закрывает websocket-соединения,
+// а затем дожидается выполнения задач воркерами и останавливает их. Процессы,
+// не успевшие завершиться до отмены ctx, убиваются.
+func shutdown(
+	ctx context.Context,
+	srv *http.Server,
+	ws *websocket.Handler,
+	listeners []net.Listener,
+) {
+	for _, l := range listeners {
+		l.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("http: shutdown error: %s", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := ws.Shutdown(ctx); err != nil {
+			log.Printf("websocket: shutdown error: %s", err)
+		}
+	}()
+	wg.Wait()
+	// HTTP-запросы обработаны, поэтому пулы можно останавливать
+	// одновременно.
+	wg.Add(len(wrkPools))
+	for _, wrks := range wrkPools {
+		go func(wrks *runner.Pool) {
+			defer wg.Done()
+			if err := wrks.Shutdown(ctx); err != nil {
+				log.Printf("%s: workers killed: %s", wrks.Name, err)
+			}
+		}(wrks)
 	}
-	defer l.Close()
+	wg.Wait()
+}
+
+func serveRPC(l net.Listener) {
 	rpc.Register(new(RPCHandler))
 	for {
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println("accept RPC connection error: ", err)
+			continue
 		}
 		go func(c net.Conn) {
 			jsonrpc.ServeConn(conn)
@@ -180,19 +450,214 @@ func (r *RPCHandler) RunJob(args []any, reply *bool) error {
 	name := args[0].(string)
 	payload := []byte(args[1].(string))
 	timeout := time.Duration(args[2].(float64))
-	go func() {
-		start := time.Now()
-		log.Printf("job: %s started", name)
-		_, err := jobsPool.Call(name, payload, time.Millisecond*timeout)
-		if err != nil {
-			log.Printf("job: %s error: %s", name, err)
-		}
-		log.Printf("job: %s finished (%s)", name, time.Since(start))
-	}()
+	go runJob(name, payload, time.Millisecond*timeout)
 	*reply = true
 	return nil
 }
 
+// runJob выполняет фоновую задачу в пуле jobsPool.
+func runJob(name string, payload []byte, timeout time.Duration) {
+	start := time.Now()
+	log.Printf("job: %s started", name)
+	_, err := jobsPool.Call(name, payload, timeout)
+	if err != nil {
+		log.Printf("job: %s error: %s", name, err)
+	}
+	log.Printf("job: %s finished (%s)", name, time.Since(start))
+}
+
+// registerServices регистрирует сервисы, доступные PHP без отдельного
+// RPC-соединения.
+func registerServices() {
+	// Публикация сообщения в топик websocket:
+	// {"topic": "chat", "message": "..."}
+	services.Register("ws.publish", func(_ context.Context, payload []byte) ([]byte, error) {
+		msg := struct {
+			Topic   string
+			Message string
+		}{}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return nil, err
+		}
+		wsPool.Publish(msg.Topic, []byte(msg.Message), "")
+		return nil, nil
+	})
+	// Постановка фоновой задачи, аналог RPCHandler.RunJob:
+	// {"name": "send-email", "payload": "...", "timeout": 1000}
+	services.Register("jobs.run", func(_ context.Context, payload []byte) ([]byte, error) {
+		job := struct {
+			Name    string
+			Payload string
+			Timeout int64
+		}{}
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return nil, err
+		}
+		if jobsPool == nil {
+			return nil, errors.New("jobs are not started")
+		}
+		go runJob(
+			job.Name,
+			[]byte(job.Payload),
+			time.Duration(job.Timeout)*time.Millisecond,
+		)
+		return nil, nil
+	})
+}
+
+// reloadOnSignal вызывает reload при получении SIGHUP, например, после
+// обновления кода приложения.
+func reloadOnSignal(reload func()) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		log.Println("SIGHUP received, reloading workers")
+		reload()
+	}
+}
+
+// reloadPools поочередно перезапускает воркеры всех пулов. Если build != nil,
+// то новые воркеры должны сообщать эту сборку. Если новые воркеры не
+// запускаются (например, из-за синтаксической ошибки в коде), то продолжают
+// работать старые, а в лог выводится ошибка из PHP.
+func reloadPools(build *string) {
+	for _, wrks := range wrkPools {
+		var err error
+		if build != nil {
+			err = wrks.ReloadBuild(context.Background(), *build)
+		} else {
+			err = wrks.Reload(context.Background())
+		}
+		if err != nil {
+			log.Printf("reload error, keeping previous workers: %s", err)
+		}
+	}
+}
+
+// readBuild читает идентификатор сборки из файла.
+func readBuild(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("could not read build: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// parseTransport возвращает транспорт для связи с воркерами по названию.
+func parseTransport(name string) (runner.Transport, error) {
+	switch name {
+	case "stdio":
+		return runner.StdioTransport{}, nil
+	case "fd":
+		return runner.FDTransport{}, nil
+	case "unix":
+		return runner.UnixTransport{}, nil
+	case "tcp":
+		return runner.TCPTransport{}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", name)
+}
+
+// openLogSink возвращает получатель логов воркеров в формате format, пишущий
+// в файл file или, если он не указан, в stderr.
+func openLogSink(format string, file string) (runner.LogSink, error) {
+	var out io.Writer
+	if file != "" {
+		f, err := os.OpenFile(
+			file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644,
+		)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	switch format {
+	case "text":
+		return runner.TextLogSink{Out: out}, nil
+	case "json":
+		return runner.JSONLogSink{Out: out}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// splitList разбирает список значений через запятую.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// parseSignal разбирает название сигнала таймаута задачи.
+func parseSignal(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "TERM":
+		return syscall.SIGTERM, nil
+	case "ALRM":
+		return syscall.SIGALRM, nil
+	}
+	return nil, fmt.Errorf("unsupported timeout signal %q", name)
+}
+
+// parseLanes разбирает список дорожек очереди в формате
+// name:weight[:max-queue[:max-workers]] через запятую.
+func parseLanes(s string) ([]runner.Lane, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var lanes []runner.Lane
+	for _, def := range strings.Split(s, ",") {
+		parts := strings.Split(def, ":")
+		if len(parts) < 2 || len(parts) > 4 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid lane %q", def)
+		}
+		nums := make([]int, 3)
+		for i, p := range parts[1:] {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid lane %q: %w", def, err)
+			}
+			nums[i] = n
+		}
+		lanes = append(lanes, runner.Lane{
+			Name:       parts[0],
+			Weight:     nums[0],
+			MaxQueue:   nums[1],
+			MaxWorkers: nums[2],
+		})
+	}
+	return lanes, nil
+}
+
+// lookupUser возвращает UID и GID пользователя и группы, заданных именем или
+// номером. Если группа не указана, используется основная группа пользователя.
+func lookupUser(name string, group string) (uid, gid uint32, err error) {
+	if name != "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			if u, err = user.LookupId(name); err != nil {
+				return 0, 0, err
+			}
+		}
+		id, _ := strconv.ParseUint(u.Uid, 10, 32)
+		uid = uint32(id)
+		if group == "" {
+			group = u.Gid
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return 0, 0, err
+			}
+		}
+		id, _ := strconv.ParseUint(g.Gid, 10, 32)
+		gid = uint32(id)
+	}
+	return uid, gid, nil
+}
+
 func mustExist(file string) {
 	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
 		log.Fatalf("file \"%s\" does not exist", file)
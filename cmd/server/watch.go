@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Период опроса файловой системы на предмет изменений.
+	watchInterval = 500 * time.Millisecond
+	// Время без изменений, после которого воркеры перезапускаются. Нужно,
+	// чтобы при сохранении нескольких файлов подряд (git checkout, замена
+	// по проекту) не перезапускать воркеры на каждый файл.
+	watchDebounce = 300 * time.Millisecond
+)
+
+// Состояние файла, по которому определяется его изменение.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// watch опрашивает директории dirs (рекурсивно) и вызывает reload, когда
+// PHP-файлы в них перестают меняться на время watchDebounce.
+func watch(dirs []string, reload func()) {
+	prev := snapshot(dirs)
+	var changed time.Time
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cur := snapshot(dirs)
+		if !equalSnapshots(prev, cur) {
+			changed = time.Now()
+			prev = cur
+			continue
+		}
+		if !changed.IsZero() && time.Since(changed) >= watchDebounce {
+			changed = time.Time{}
+			reload()
+		}
+	}
+}
+
+// snapshot собирает состояние всех PHP-файлов в директориях dirs. Скрытые
+// директории пропускаются.
+func snapshot(dirs []string) map[string]fileState {
+	res := make(map[string]fileState)
+	for _, dir := range dirs {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Файл мог быть удален во время обхода.
+				return nil
+			}
+			if d.IsDir() {
+				if path != dir && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filepath.Ext(path) != ".php" {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			res[path] = fileState{modTime: info.ModTime(), size: info.Size()}
+			return nil
+		})
+	}
+	return res
+}
+
+func equalSnapshots(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// watchDirs возвращает директории, в которых лежат указанные скрипты, без
+// повторов.
+func watchDirs(scripts ...string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, s := range scripts {
+		if s == "" {
+			continue
+		}
+		dir, err := filepath.Abs(filepath.Dir(s))
+		if err != nil {
+			log.Printf("watch: %s", err)
+			continue
+		}
+		if _, err := os.Stat(dir); err != nil || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
@@ -0,0 +1,115 @@
+// Версия 2 протокола передает все сообщения кадрами с бинарным заголовком
+// фиксированной длины (big endian):
+//
+//	magic   uint16  0x4352 ("CR")
+//	version uint8   2
+//	type    uint8   тип кадра
+//	flags   uint32  флаги, зависящие от типа кадра
+//	id      uint64  идентификатор запроса
+//	length  uint32  длина данных кадра
+//
+// За заголовком следуют length байт данных. Кадры всегда содержат
+// идентификатор запроса, поэтому ответы сопоставляются с запросами так же,
+// как в режиме мультиплексирования (см. mux.go). Без параметра mux в строке
+// готовности процесс выполняет одну задачу за раз.
+package corerunner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	protoV1 = 1
+	protoV2 = 2
+
+	frameMagic      = 0x4352
+	frameHeaderSize = 20
+)
+
+// Тип кадра протокола версии 2.
+type frameType uint8
+
+const (
+	// Запрос от Go к процессу.
+	frameRequest frameType = iota + 1
+	// Ответ процесса на запрос с тем же идентификатором. С флагом
+	// frameFlagError содержит текст ошибки, с которой процесс не смог
+	// выполнить задачу, например, после TimeoutSignal (см. ErrJobFailed).
+	frameResponse
+	// Просьба к процессу штатно завершиться, аналог пустой строки в
+	// версии 1.
+	frameStop
+	// Вызов сервиса Go процессом во время выполнения задачи (см.
+	// services.go).
+	frameCall
+	// Ответ Go на вызов с тем же идентификатором.
+	frameReply
+	// Часть потокового ответа на запрос. Процесс может отправить сколько
+	// угодно частей, после которых обязательно отправляет frameResponse.
+	frameChunk
+	// Проверка работоспособности простаивающего процесса (см.
+	// Pool.PingInterval). Отправляется только процессам, заявившим ping в
+	// строке готовности (см. handshake.go).
+	framePing
+	// Ответ процесса на framePing с тем же идентификатором. С флагом
+	// frameFlagError содержит текст ошибки, например, если приложение
+	// потеряло соединение с базой данных.
+	framePong
+)
+
+const (
+	// Ответ на запрос, вызов или ping содержит текст ошибки.
+	frameFlagError uint32 = 1 << iota
+)
+
+type frame struct {
+	typ   frameType
+	flags uint32
+	id    uint64
+	data  []byte
+}
+
+// readFrame читает кадр с данными не длиннее limit (см. readBody).
+func readFrame(r io.Reader, limit int) (frame, error) {
+	var h [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return frame{}, err
+	}
+	if m := binary.BigEndian.Uint16(h[0:2]); m != frameMagic {
+		return frame{}, fmt.Errorf("invalid frame magic %#04x", m)
+	}
+	if h[2] != protoV2 {
+		return frame{}, fmt.Errorf("unsupported frame version %d", h[2])
+	}
+	f := frame{
+		typ:   frameType(h[3]),
+		flags: binary.BigEndian.Uint32(h[4:8]),
+		id:    binary.BigEndian.Uint64(h[8:16]),
+	}
+	data, err := readBody(r, int(binary.BigEndian.Uint32(h[16:20])), limit)
+	if err != nil {
+		return frame{}, err
+	}
+	f.data = data
+	return f, nil
+}
+
+func writeFrame(w *bufio.Writer, f frame) error {
+	var h [frameHeaderSize]byte
+	binary.BigEndian.PutUint16(h[0:2], frameMagic)
+	h[2] = protoV2
+	h[3] = byte(f.typ)
+	binary.BigEndian.PutUint32(h[4:8], f.flags)
+	binary.BigEndian.PutUint64(h[8:16], f.id)
+	binary.BigEndian.PutUint32(h[16:20], uint32(len(f.data)))
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(f.data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
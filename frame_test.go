@@ -0,0 +1,59 @@
+package corerunner
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	data := bytes.Repeat([]byte("x"), PipeChunkSize*2+1)
+	in := frame{typ: frameResponse, flags: 3, id: 42, data: data}
+	if err := writeFrame(bufio.NewWriter(buf), in); err != nil {
+		t.Fatalf("could not write frame: %s", err)
+	}
+	if buf.Len() != frameHeaderSize+len(data) {
+		t.Fatalf("frame size does not match: %d", buf.Len())
+	}
+	out, err := readFrame(buf, 0)
+	if err != nil {
+		t.Fatalf("could not read frame: %s", err)
+	}
+	if out.typ != in.typ || out.flags != in.flags || out.id != in.id ||
+		!bytes.Equal(out.data, in.data) {
+		t.Fatalf("frames do not match: %+v and %+v", in, out)
+	}
+	if _, err = readFrame(bytes.NewReader([]byte("20\nhello world, hello world")), 0); err == nil {
+		t.Fatal("v1 message must be rejected")
+	}
+}
+
+func TestMessageLimit(t *testing.T) {
+	// Случайный вывод в протокол не должен приводить к выделению памяти
+	// под заявленную длину.
+	wrk := &Worker{read: bufio.NewReader(strings.NewReader("99999999999999\n"))}
+	if _, err := wrk.readMsg(); !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("expected errMessageTooLarge, got %v", err)
+	}
+	buf := &bytes.Buffer{}
+	data := bytes.Repeat([]byte("x"), readBodyChunk*3+1)
+	in := frame{typ: frameResponse, id: 1, data: data}
+	if err := writeFrame(bufio.NewWriter(buf), in); err != nil {
+		t.Fatalf("could not write frame: %s", err)
+	}
+	raw := buf.Bytes()
+	if _, err := readFrame(bytes.NewReader(raw), len(data)-1); !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("expected errMessageTooLarge, got %v", err)
+	}
+	out, err := readFrame(bytes.NewReader(raw), len(data))
+	if err != nil || !bytes.Equal(out.data, data) {
+		t.Fatalf("could not read frame of limit size: %v", err)
+	}
+	if _, err = readFrame(bytes.NewReader(raw[:len(raw)-1]), 0); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
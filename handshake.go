@@ -0,0 +1,238 @@
+package corerunner
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Версии протокола, которые поддерживает Go, по возрастанию.
+var protoVersions = []int{protoV1, protoV2}
+
+// Разобранная строка готовности процесса. Процесс может перечислить
+// параметры после ok:
+// ok proto=1,2 mux=8\n
+//
+// proto -- поддерживаемые процессом версии протокола (по умолчанию только 1),
+// mux -- максимальное количество одновременно выполняемых задач (см. mux.go),
+// pid -- PID внешнего процесса (см. Pool.Serve), используется только в логах и
+// статистике,
+// token -- секрет внешнего процесса (см. Pool.WorkerToken),
+// ping (без значения) -- процесс отвечает на кадры framePing в версии 2
+// протокола (см. Pool.PingInterval).
+// Если процесс заявил хотя бы один параметр, Go отвечает строкой с выбранными
+// значениями:
+// proto=2 mux=4\n
+//
+// Строка ok\n без параметров соответствует первой версии протокола без
+// мультиплексирования, ответ на нее не отправляется.
+//
+// Вместо ok процесс может отправить структурированное приветствие hello с
+// объектом JSON, на которое Go отвечает так же:
+// hello {"proto":[1,2],"runtime":"php 8.3.1","frames":[1,2,3,4,5,6,7,8],
+// "app":"shop","build":"1f3a9c2","jobs":["mail"],"mux":8,"pid":42}\n
+//
+// Кроме параметров строки ok, оно содержит версию среды выполнения, типы
+// кадров версии 2 протокола, которые понимает процесс (см. frame.go),
+// название и сборку приложения, а также названия выполняемых задач. Go
+// сверяет их с настройками пула (см. Pool.App, Pool.Build и
+// Pool.RequiredJobs) и не допускает к работе несовместимые процессы,
+// например, процессы со старым кодом во время выкладки.
+type handshake struct {
+	versions []int
+	mux      int
+	pid      int
+	token    string
+	ping     bool
+	// Поля, которые есть только в приветствии hello.
+	runtime string
+	frames  []frameType
+	app     string
+	build   string
+	jobs    []string
+}
+
+// Приветствие hello в JSON.
+type hello struct {
+	Proto   []int    `json:"proto"`
+	Runtime string   `json:"runtime"`
+	Frames  []int    `json:"frames"`
+	App     string   `json:"app"`
+	Build   string   `json:"build"`
+	Jobs    []string `json:"jobs"`
+	Mux     int      `json:"mux"`
+	PID     int      `json:"pid"`
+	Token   string   `json:"token"`
+}
+
+// parseHandshake разбирает строку готовности процесса. Неизвестные параметры
+// игнорируются.
+func parseHandshake(l string) (handshake, error) {
+	if strings.HasPrefix(l, "hello ") {
+		return parseHello(strings.TrimPrefix(l, "hello "))
+	}
+	h := handshake{}
+	fields := strings.Fields(l)
+	if len(fields) == 0 || fields[0] != "ok" || !strings.HasSuffix(l, "\n") {
+		return h, fmt.Errorf("unexpected handshake %q", l)
+	}
+	for _, f := range fields[1:] {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "proto":
+			for _, s := range strings.Split(v, ",") {
+				ver, err := strconv.Atoi(s)
+				if err != nil || ver < 1 {
+					return h, fmt.Errorf("invalid proto value %q", v)
+				}
+				h.versions = append(h.versions, ver)
+			}
+		case "mux":
+			mux, err := strconv.Atoi(v)
+			if err != nil || mux < 1 {
+				return h, fmt.Errorf("invalid mux value %q", v)
+			}
+			h.mux = mux
+		case "pid":
+			pid, err := strconv.Atoi(v)
+			if err != nil || pid < 0 {
+				return h, fmt.Errorf("invalid pid value %q", v)
+			}
+			h.pid = pid
+		case "token":
+			h.token = v
+		case "ping":
+			h.ping = true
+		}
+	}
+	return h, nil
+}
+
+// parseHello разбирает приветствие hello без префикса.
+func parseHello(data string) (handshake, error) {
+	var msg hello
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		return handshake{}, fmt.Errorf("invalid hello: %w", err)
+	}
+	if len(msg.Proto) == 0 {
+		return handshake{}, fmt.Errorf("hello has no proto")
+	}
+	for _, v := range msg.Proto {
+		if v < 1 {
+			return handshake{}, fmt.Errorf("invalid proto value %d", v)
+		}
+	}
+	if msg.Mux < 0 || msg.PID < 0 {
+		return handshake{}, fmt.Errorf("invalid mux or pid in hello")
+	}
+	h := handshake{
+		versions: msg.Proto,
+		mux:      msg.Mux,
+		pid:      msg.PID,
+		token:    msg.Token,
+		runtime:  msg.Runtime,
+		app:      msg.App,
+		build:    msg.Build,
+		jobs:     msg.Jobs,
+	}
+	for _, f := range msg.Frames {
+		h.frames = append(h.frames, frameType(f))
+	}
+	h.ping = h.supports(framePing)
+	return h, nil
+}
+
+// check проверяет, что процесс подходит пулу: относится к приложению app и
+// сборке build, если они заданы, выполняет задачи jobs, а в версии 2
+// протокола понимает необходимые кадры.
+func (h handshake) check(proto int, app, build string, jobs []string) error {
+	if app != "" && h.app != app {
+		return fmt.Errorf("worker app %q does not match %q", h.app, app)
+	}
+	if build != "" && h.build != build {
+		return fmt.Errorf("worker build %q does not match %q", h.build, build)
+	}
+	for _, job := range jobs {
+		if !h.handles(job) {
+			return fmt.Errorf("worker does not handle job %q", job)
+		}
+	}
+	if proto == protoV2 && len(h.frames) > 0 {
+		for _, f := range []frameType{frameRequest, frameResponse, frameStop} {
+			if !h.supports(f) {
+				return fmt.Errorf("worker does not support frame type %d", f)
+			}
+		}
+	}
+	return nil
+}
+
+// checkToken проверяет, что внешний процесс сообщил секрет token, если он
+// задан.
+func (h handshake) checkToken(token string) error {
+	if token == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(h.token), []byte(token)) != 1 {
+		return errors.New("invalid worker token")
+	}
+	return nil
+}
+
+// supports сообщает, что процесс поддерживает кадры типа typ.
+func (h handshake) supports(typ frameType) bool {
+	for _, f := range h.frames {
+		if f == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// handles сообщает, что процесс выполняет задачи job.
+func (h handshake) handles(job string) bool {
+	for _, j := range h.jobs {
+		if j == job {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate выбирает старшую общую версию протокола и количество одновременно
+// выполняемых задач, не большее concurrency. Возвращает также строку ответа
+// процессу или "", если ответ не нужен.
+func (h handshake) negotiate(concurrency int) (proto, mux int, reply string, err error) {
+	if len(h.versions) == 0 {
+		proto = protoV1
+	}
+	for _, v := range h.versions {
+		for _, s := range protoVersions {
+			if v == s && v > proto {
+				proto = v
+			}
+		}
+	}
+	if proto == 0 {
+		return 0, 0, "", fmt.Errorf(
+			"no supported protocol version in %v, supported %v",
+			h.versions,
+			protoVersions,
+		)
+	}
+	var params []string
+	if len(h.versions) > 0 {
+		params = append(params, "proto="+strconv.Itoa(proto))
+	}
+	if h.mux > 0 {
+		mux = min(h.mux, max(concurrency, 1))
+		params = append(params, "mux="+strconv.Itoa(mux))
+	}
+	if len(params) > 0 {
+		reply = strings.Join(params, " ") + "\n"
+	}
+	return proto, mux, reply, nil
+}
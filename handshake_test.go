@@ -0,0 +1,123 @@
+package corerunner
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	cases := []struct {
+		line        string
+		concurrency int
+		proto, mux  int
+		reply       string
+	}{
+		{"ok\n", 4, 1, 0, ""},
+		{"ok mux=8\n", 4, 1, 4, "mux=4\n"},
+		{"ok foo proto=1,2 mux=2\n", 4, 2, 2, "proto=2 mux=2\n"},
+		{"ok proto=2,3\n", 0, 2, 0, "proto=2\n"},
+	}
+	for _, c := range cases {
+		h, err := parseHandshake(c.line)
+		if err != nil {
+			t.Fatalf("could not parse %q: %s", c.line, err)
+		}
+		proto, mux, reply, err := h.negotiate(c.concurrency)
+		if err != nil {
+			t.Fatalf("could not negotiate %q: %s", c.line, err)
+		}
+		if proto != c.proto || mux != c.mux || reply != c.reply {
+			t.Fatalf(
+				"negotiated %q does not match: %d %d %q and %d %d %q",
+				c.line, c.proto, c.mux, c.reply, proto, mux, reply,
+			)
+		}
+	}
+	for _, l := range []string{"Fatal error\n", "ok mux=0\n", "ok"} {
+		if _, err := parseHandshake(l); err == nil {
+			t.Fatalf("handshake %q must be rejected", l)
+		}
+	}
+	if h, _ := parseHandshake("ok proto=1,2 ping\n"); !h.ping {
+		t.Fatal("ping support is not parsed")
+	}
+	h, _ := parseHandshake("ok proto=3\n")
+	if _, _, _, err := h.negotiate(1); err == nil {
+		t.Fatal("unsupported protocol version must be rejected")
+	}
+}
+
+func TestHello(t *testing.T) {
+	h, err := parseHandshake(`hello {"proto":[1,2],"runtime":"php 8.3.1","frames":[1,2,3,7,8],"app":"shop","build":"b2","jobs":["mail","resize"],"pid":42,"token":"s3"}` + "\n")
+	if err != nil {
+		t.Fatalf("could not parse hello: %s", err)
+	}
+	if !h.ping || h.pid != 42 || h.runtime != "php 8.3.1" {
+		t.Fatalf("hello is not parsed: %+v", h)
+	}
+	proto, _, reply, err := h.negotiate(1)
+	if err != nil || proto != protoV2 || reply != "proto=2\n" {
+		t.Fatalf("could not negotiate hello: %d %q %v", proto, reply, err)
+	}
+	if err := h.check(proto, "shop", "b2", []string{"mail"}); err != nil {
+		t.Fatalf("matching worker is refused: %s", err)
+	}
+	if h.checkToken("s3") != nil || h.checkToken("s4") == nil {
+		t.Fatal("worker token is not checked")
+	}
+	if err := h.check(proto, "", "b1", nil); err == nil {
+		t.Fatal("worker with another build must be refused")
+	}
+	if err := h.check(proto, "", "", []string{"report"}); err == nil {
+		t.Fatal("worker without required job must be refused")
+	}
+	h.frames = h.frames[1:]
+	if err := h.check(proto, "", "", nil); err == nil {
+		t.Fatal("worker without request frames must be refused")
+	}
+	if _, err := parseHandshake("hello {\"app\":\"shop\"}\n"); err == nil {
+		t.Fatal("hello without proto must be rejected")
+	}
+}
+
+// Соединение внешнего воркера с другого хоста.
+type remoteConn struct {
+	net.Conn
+}
+
+func (remoteConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 40000}
+}
+
+func TestWorkerToken(t *testing.T) {
+	p := &Pool{}
+	if err := p.Start(nil, 0, nil); err != nil {
+		t.Fatalf("could not start pool: %s", err)
+	}
+	defer p.Stop()
+	// connect подключает внешний воркер с секретом token и сообщает,
+	// принял ли его пул.
+	connect := func(remote bool, token string) bool {
+		srv, cli := net.Pipe()
+		go func() {
+			fmt.Fprintf(cli, "ok token=%s\n", token)
+			io.Copy(io.Discard, cli)
+		}()
+		n := len(p.externalWorkers())
+		if remote {
+			p.attach(remoteConn{srv})
+		} else {
+			p.attach(srv)
+		}
+		return len(p.externalWorkers()) > n
+	}
+	if !connect(false, "") || connect(true, "") {
+		t.Fatal("only local workers must be accepted without token")
+	}
+	p.WorkerToken = "s3"
+	if !connect(true, "s3") || connect(true, "s4") || connect(false, "") {
+		t.Fatal("only workers with valid token must be accepted")
+	}
+}
@@ -0,0 +1,52 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	runner "github.com/ruvents/corerunner"
+)
+
+type HealthHandler struct {
+	pools []*runner.Pool
+}
+
+// NewHealthHandler инициализирует обработчик для health-check'ов. Отвечает
+// 200, если все пулы pools работают нормально, и 503, если хотя бы один из
+// них деградировал (см. runner.Pool.Degraded).
+func NewHealthHandler(pools ...*runner.Pool) *HealthHandler {
+	return &HealthHandler{pools: pools}
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("cache-control", "no-store")
+	for _, p := range h.pools {
+		if p.Degraded() {
+			http.Error(w, "degraded", 503)
+			return
+		}
+	}
+	fmt.Fprint(w, "ok")
+}
+
+type ReadinessHandler struct {
+	pools []*runner.Pool
+}
+
+// NewReadinessHandler инициализирует обработчик для readiness-проверок.
+// Отвечает 200, если все пулы pools готовы выполнять задачи, и 503, если хотя
+// бы один из них не готов (см. runner.Pool.Ready).
+func NewReadinessHandler(pools ...*runner.Pool) *ReadinessHandler {
+	return &ReadinessHandler{pools: pools}
+}
+
+func (h *ReadinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("cache-control", "no-store")
+	for _, p := range h.pools {
+		if !p.Ready() {
+			http.Error(w, "not ready", 503)
+			return
+		}
+	}
+	fmt.Fprint(w, "ok")
+}
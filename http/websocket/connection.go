@@ -37,6 +37,12 @@ type Connection struct {
 	msgHandler   MessageHandler
 	closeHandler CloseHandler
 	mu           sync.Mutex
+	// Код, отправляемый клиенту при закрытии соединения, или 0.
+	closeCode int
+	// Вызывается один раз при закрытии соединения.
+	release func()
+	// Закрывается после отправки сообщения о закрытии соединения.
+	done chan struct{}
 }
 
 // NewConnection инициализирует новое соединение-обертку над conn. При
@@ -55,6 +61,7 @@ func NewConnection(
 		msgHandler:   msgHandler,
 		closeHandler: closeHandler,
 		closed:       false,
+		done:         make(chan struct{}),
 	}
 }
 
@@ -71,13 +78,22 @@ func (conn *Connection) Send(data []byte) {
 // Close закрывает websocket соединение. При закрытии будет выполнен
 // closeHandler. После закрытия метод Write становится NOOP.
 func (conn *Connection) Close() {
+	conn.closeWith(0)
+}
+
+// closeWith закрывает соединение, отправляя клиенту код code.
+func (conn *Connection) closeWith(code int) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 	if conn.closed {
 		return
 	}
+	conn.closeCode = code
 	close(conn.send)
 	conn.closed = true
+	if conn.release != nil {
+		conn.release()
+	}
 }
 
 func (conn *Connection) isClosed() bool {
@@ -94,6 +110,7 @@ func (conn *Connection) write() {
 			conn.closeHandler(conn)
 		}
 		conn.Close()
+		close(conn.done)
 	}()
 
 	for {
@@ -108,7 +125,11 @@ func (conn *Connection) write() {
 				// Канал conn.send был закрыт. Отправляем
 				// сообщение клиенту о закрытии соединения и
 				// закрываем его.
-				conn.connection.WriteMessage(websocket.CloseMessage, []byte{})
+				msg := []byte{}
+				if conn.closeCode != 0 {
+					msg = websocket.FormatCloseMessage(conn.closeCode, "")
+				}
+				conn.connection.WriteMessage(websocket.CloseMessage, msg)
 				conn.connection.Close()
 				return
 			}
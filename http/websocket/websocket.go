@@ -1,8 +1,10 @@
 package websocket
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"sync"
 
 	// XXX: переделать на https://github.com/nhooyr/websocket
 	"github.com/gorilla/websocket"
@@ -27,6 +29,9 @@ type CloseHandler func(conn *Connection)
 type Handler struct {
 	msgHandler   MessageHandler
 	closeHandler CloseHandler
+	// Открытые соединения, которые нужно закрыть при Shutdown.
+	conns map[*Connection]struct{}
+	mu    sync.Mutex
 }
 
 // NewHandler инициализирует HTTP-обработчик для websocket-подключений.
@@ -34,6 +39,7 @@ func NewHandler(msgHandler MessageHandler, closeHandler CloseHandler) *Handler {
 	return &Handler{
 		msgHandler:   msgHandler,
 		closeHandler: closeHandler,
+		conns:        make(map[*Connection]struct{}),
 	}
 }
 
@@ -44,8 +50,39 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	connection := NewConnection(conn, h.msgHandler, h.closeHandler)
+	h.mu.Lock()
+	h.conns[&connection] = struct{}{}
+	h.mu.Unlock()
+	connection.release = func() {
+		h.mu.Lock()
+		delete(h.conns, &connection)
+		h.mu.Unlock()
+	}
 	// Запускаем чтение и запись в горутинах, чтобы GC мог начать чистить
 	// неиспользуемую память.
 	go connection.read()
 	go connection.write()
 }
+
+// Shutdown отправляет всем открытым соединениям сообщение о закрытии с кодом
+// 1001 (going away) и дожидается его отправки или отмены ctx. Соединения,
+// открытые через websocket, не закрываются http.Server.Shutdown.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	conns := make([]*Connection, 0, len(h.conns))
+	for conn := range h.conns {
+		conns = append(conns, conn)
+	}
+	h.mu.Unlock()
+	for _, conn := range conns {
+		conn.closeWith(websocket.CloseGoingAway)
+	}
+	for _, conn := range conns {
+		select {
+		case <-conn.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
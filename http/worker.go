@@ -2,8 +2,8 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -15,6 +15,22 @@ import (
 )
 
 type WorkerHandler struct {
+	// Размер тела запроса (в байтах), начиная с которого тело сохраняется во
+	// временный файл и передается воркеру путем в HTTPRequest.BodyPath
+	// вместо копирования в сообщение. Тела multipart/form-data не
+	// учитываются, их файлы и так передаются путями. Файл передается
+	// пользователю воркеров (см. runner.Isolation). При 0 тело всегда
+	// передается в сообщении.
+	BodySpillThreshold int64
+	// Возвращает дорожку очереди воркеров (см. runner.Lane) для запроса,
+	// например, по пути или заголовку, выставленному прокси. Если nil, все
+	// запросы попадают в первую дорожку.
+	Lane func(r *http.Request) string
+	// Возвращает ключ привязки запроса к воркеру (см. runner.WithAffinity),
+	// например, идентификатор клиента. Запросы с пустым ключом выполняются
+	// любым воркером.
+	Affinity func(r *http.Request) string
+
 	wrks          *runner.Pool
 	cors          bool
 	timeout       time.Duration
@@ -45,7 +61,11 @@ func NewWorkerHandler(
 
 const (
 	ErrWeb500 = "something went wrong on server side"
+	ErrWeb503 = "server is overloaded, try again later"
 	ErrWeb404 = "not found"
+	// Через сколько секунд клиенту стоит повторить запрос, если очередь
+	// воркеров переполнена.
+	retryAfter = "1"
 )
 
 func (h *WorkerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -62,7 +82,13 @@ func (h *WorkerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ErrWeb500, 500)
 		return
 	}
-	buf := bytes.NewBuffer([]byte{})
+	if m.BodyPath != "" {
+		defer os.Remove(m.BodyPath)
+	}
+	// Буфер возвращается в пул только после ответа воркера, который
+	// читает из него запрос.
+	buf := runner.GetBuffer()
+	defer runner.PutBuffer(buf)
 	// Заранее увеличиваем буфер, чтобы не делать это слишком часто при
 	// записи в него.
 	buf.Grow(len(m.Body) + 4096)
@@ -72,9 +98,66 @@ func (h *WorkerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ErrWeb500, 500)
 		return
 	}
-	wrkCh := h.wrks.Send(buf.Bytes(), h.timeout)
+	// Потоковый ответ: первая часть содержит статус и заголовки (и,
+	// возможно, начало тела), остальные -- продолжение тела.
+	var status uint64
+	streamed := false
+	onChunk := func(chunk []byte) error {
+		if !streamed {
+			var res runner.HTTPResponse
+			if err := res.Parse(bytes.NewReader(chunk)); err != nil {
+				return err
+			}
+			streamed = true
+			status = res.StatusCode
+			for k, h := range res.Headers {
+				w.Header().Set(k, h)
+			}
+			w.WriteHeader(int(res.StatusCode))
+			chunk = res.Body
+		}
+		return writeChunk(w, chunk)
+	}
+	ctx := r.Context()
+	// Идентификатор запроса, выставленный прокси, помечает логи воркера.
+	if id := r.Header.Get("x-request-id"); id != "" {
+		ctx = runner.WithRequestID(ctx, id)
+	}
+	if h.Lane != nil {
+		ctx = runner.WithLane(ctx, h.Lane(r))
+	}
+	if h.Affinity != nil {
+		ctx = runner.WithAffinity(ctx, h.Affinity(r))
+	}
+	wrkCh := h.wrks.SendStream(ctx, buf.Bytes(), h.timeout, onChunk)
 	wrkRes := <-wrkCh
 	err = wrkRes.Err
+	if streamed {
+		// Статус уже отправлен, поэтому ошибку можно только записать в
+		// лог, а окончательный ответ -- последняя часть тела.
+		if err == nil {
+			h.timeoutsCount = 0
+			_, err = w.Write(wrkRes.Res)
+		}
+		if err != nil {
+			log.Printf("stream error %s %s: %s", r.Method, r.URL.Path, err)
+		}
+		log.Printf("%d %s %s (%s, streamed)\n", status, r.Method, r.URL.Path, time.Since(start))
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// Клиент отключился, отвечать некому.
+		log.Printf("canceled %s %s (%s)\n", r.Method, r.URL.Path, time.Since(start))
+		return
+	}
+	if errors.Is(err, runner.ErrQueueFull) ||
+		errors.Is(err, runner.ErrQueueTimeout) ||
+		errors.Is(err, runner.ErrPoolStopped) {
+		log.Printf("503 %s %s: %s (%s)\n", r.Method, r.URL.Path, err, time.Since(start))
+		w.Header().Set("retry-after", retryAfter)
+		http.Error(w, ErrWeb503, 503)
+		return
+	}
 	if err != nil {
 		if errors.Is(err, runner.ErrWorkerTimedOut) {
 			h.timeoutsCount = h.timeoutsCount + 1
@@ -102,10 +185,22 @@ func (h *WorkerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set(k, h)
 	}
 	w.WriteHeader(int(res.StatusCode))
-	fmt.Fprint(w, string(res.Body))
+	w.Write(res.Body)
 	log.Printf("%d %s %s (%s)\n", res.StatusCode, r.Method, r.URL.Path, time.Since(start))
 }
 
+// writeChunk отправляет клиенту часть потокового ответа, не дожидаясь
+// остальных.
+func writeChunk(w http.ResponseWriter, chunk []byte) error {
+	if _, err := w.Write(chunk); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
 func (h *WorkerHandler) formRequest(r *http.Request) (*runner.HTTPRequest, error) {
 	m := runner.HTTPRequest{}
 	m.URL = r.URL.String()
@@ -139,16 +234,53 @@ func (h *WorkerHandler) formRequest(r *http.Request) (*runner.HTTPRequest, error
 			m.Form[k] = v[0]
 		}
 	} else {
-		d, err := io.ReadAll(r.Body)
+		d, path, err := h.readBody(r)
 		if err != nil {
 			return nil, err
 		}
 		m.Body = d
+		m.BodyPath = path
 	}
 
 	return &m, nil
 }
 
+// readBody считывает тело запроса в память или, если оно больше
+// BodySpillThreshold, во временный файл, путь к которому возвращается.
+func (h *WorkerHandler) readBody(r *http.Request) ([]byte, string, error) {
+	if h.BodySpillThreshold <= 0 {
+		d, err := io.ReadAll(r.Body)
+		return d, "", err
+	}
+	// Длина тела может быть неизвестна заранее, поэтому сначала читаем не
+	// больше порога.
+	buf := &bytes.Buffer{}
+	if r.ContentLength <= h.BodySpillThreshold {
+		_, err := io.CopyN(buf, r.Body, h.BodySpillThreshold+1)
+		if err == io.EOF {
+			return buf.Bytes(), "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	f, err := os.CreateTemp("", "corerunner-body-*")
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	// Файл создается доступным только corerunner, а воркеры могут работать
+	// от имени другого пользователя.
+	if err = h.wrks.Isolation.Chown(f); err == nil {
+		_, err = io.Copy(f, io.MultiReader(buf, r.Body))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	return nil, f.Name(), nil
+}
+
 func (h *WorkerHandler) parseFiles(r *http.Request) (map[string]*runner.File, error) {
 	// Сохраняем файлы из запроса во временные файлы для передачи их путей
 	// в воркер. Временные файлы будут удалены по завершению обработки
@@ -0,0 +1,123 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	runner "github.com/ruvents/corerunner"
+)
+
+func TestReadBody(t *testing.T) {
+	h := NewWorkerHandler(&runner.Pool{}, false, time.Second, 1)
+	if os.Getuid() == 0 {
+		// Файл передается пользователю воркеров.
+		h.wrks.Isolation = runner.Isolation{UID: 65534, GID: 65534}
+	}
+	h.BodySpillThreshold = 10
+	cases := []struct {
+		body    string
+		length  int64
+		spilled bool
+	}{
+		{"0123456789", 10, false},
+		{"0123456789a", 11, true},
+		// Длина тела неизвестна заранее, например, при chunked.
+		{"0123456789", -1, false},
+		{"0123456789a", -1, true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.body))
+		r.ContentLength = c.length
+		d, path, err := h.readBody(r)
+		if err != nil {
+			t.Fatalf("could not read body %q: %s", c.body, err)
+		}
+		if (path != "") != c.spilled {
+			t.Fatalf("body %q of length %d spilled: %t", c.body, c.length, path != "")
+		}
+		if path != "" {
+			d, err = os.ReadFile(path)
+			os.Remove(path)
+			if err != nil {
+				t.Fatalf("could not read spilled body: %s", err)
+			}
+		}
+		if string(d) != c.body {
+			t.Fatalf("body does not match: %q and %q", c.body, d)
+		}
+	}
+}
+
+func TestBodySpillCleanup(t *testing.T) {
+	p := &runner.Pool{}
+	if err := p.Start(nil, 0, nil); err != nil {
+		t.Fatalf("could not start pool: %s", err)
+	}
+	defer p.Stop()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	defer l.Close()
+	go p.Serve(l)
+	// Внешний воркер отвечает телом запроса, прочитанным из файла, и
+	// сообщает путь к файлу.
+	paths := make(chan string, 1)
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		io.WriteString(conn, "ok\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\n" {
+				return
+			}
+			ln, _ := strconv.Atoi(strings.TrimSuffix(line, "\n"))
+			msg := make([]byte, ln)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			var req runner.HTTPRequest
+			if err := req.Parse(bytes.NewReader(msg)); err != nil {
+				return
+			}
+			body, _ := os.ReadFile(req.BodyPath)
+			paths <- req.BodyPath
+			res := &bytes.Buffer{}
+			(&runner.HTTPResponse{StatusCode: 200, Body: body}).Write(res)
+			io.WriteString(conn, strconv.Itoa(res.Len())+"\n")
+			conn.Write(res.Bytes())
+		}
+	}()
+	for !p.Ready() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	h := NewWorkerHandler(p, false, time.Second, 1)
+	h.BodySpillThreshold = 4
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("spilled")))
+	if w.Code != 200 || w.Body.String() != "spilled" {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	path := <-paths
+	if path == "" {
+		t.Fatal("body is not spilled")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("spilled body is not removed: %v", err)
+	}
+}
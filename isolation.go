@@ -0,0 +1,101 @@
+package corerunner
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+var errIsolationUnsupported = errors.New("process isolation is supported only on Linux")
+
+// Isolation ограничивает права и ресурсы запускаемых процессов. Поддерживается
+// только в Linux. Процессы в Linux всегда запускаются в собственной группе
+// процессов, поэтому при убийстве воркера завершаются и запущенные им
+// дочерние процессы.
+type Isolation struct {
+	// Пользователь и группа, от имени которых запускаются процессы. При 0
+	// используются пользователь и группа corerunner.
+	UID uint32
+	GID uint32
+	// Ограничения RLIMIT_* и группа cgroup применяются к процессу до
+	// выполнения его команды, поэтому действуют и на все его дочерние
+	// процессы. Для этого процесс запускается через /bin/sh, который
+	// дожидается их применения и заменяется командой через exec.
+	// Ограничения устанавливаются через prlimit, для процесса другого
+	// пользователя это требует CAP_SYS_RESOURCE.
+	//
+	// Ограничение виртуальной памяти процесса (RLIMIT_AS) в байтах. При 0
+	// не ограничивается.
+	MaxAddressSpace uint64
+	// Максимальное количество открытых файлов (RLIMIT_NOFILE), не меньше
+	// 16, иначе /bin/sh не сможет запустить команду. При 0 не
+	// ограничивается.
+	MaxOpenFiles uint64
+	// Процессорное время (RLIMIT_CPU), после которого процесс получает
+	// SIGKILL. Учитывается за все время работы процесса, а не одной задачи,
+	// поэтому имеет смысл вместе с MaxJobs или MaxUptime. При 0 не
+	// ограничивается.
+	MaxCPUTime time.Duration
+	// Путь к группе cgroup v2, например, /sys/fs/cgroup/corerunner/http, в
+	// которую помещаются процессы. Pool создает ее при запуске и удаляет
+	// при остановке. Родительская группа должна существовать и быть
+	// доступна для записи.
+	Cgroup string
+	// Ограничение памяти всех процессов группы (memory.max) в байтах. При 0
+	// не ограничивается.
+	CgroupMemoryMax uint64
+	// Ограничение процессорного времени всех процессов группы (cpu.max) в
+	// количестве процессоров, например, 1.5. При 0 не ограничивается.
+	CgroupCPUMax float64
+}
+
+// Chown передает пользователю и группе процессов файл f, созданный
+// corerunner, например, временный файл с телом запроса, который процесс
+// другого пользователя иначе не сможет открыть. Если пользователь и группа не
+// заданы, ничего не делает.
+func (iso Isolation) Chown(f *os.File) error {
+	if iso.UID == 0 && iso.GID == 0 {
+		return nil
+	}
+	uid, gid := -1, -1
+	if iso.UID != 0 {
+		uid = int(iso.UID)
+	}
+	if iso.GID != 0 {
+		gid = int(iso.GID)
+	}
+	return f.Chown(uid, gid)
+}
+
+// Запуск процесса, отложенный до применения ограничений (см.
+// Isolation.gate). nil, если откладывать запуск не нужно.
+type isolationGate struct {
+	// Копии дескрипторов, переданные процессу.
+	child []*os.File
+	// Результат применения ограничений.
+	res chan error
+}
+
+// started закрывает копии дескрипторов процесса после его запуска. Без этого
+// ожидание PID процесса не завершится, если процесс не запустился.
+func (g *isolationGate) started() {
+	if g == nil {
+		return
+	}
+	for _, f := range g.child {
+		f.Close()
+	}
+}
+
+// wait дожидается применения ограничений к запущенному процессу.
+func (g *isolationGate) wait() error {
+	if g == nil {
+		return nil
+	}
+	return <-g.res
+}
+
+// enabled сообщает, что задано хотя бы одно ограничение.
+func (iso Isolation) enabled() bool {
+	return iso != Isolation{}
+}
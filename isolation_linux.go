@@ -0,0 +1,217 @@
+//go:build linux
+
+package corerunner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// Период cpu.max в микросекундах.
+const cgroupCPUPeriod = 100000
+
+// Обертка, через которую запускается процесс с ограничениями: сообщает свой
+// PID в дескриптор %[1]d, ждет разрешения из дескриптора %[2]d и заменяется
+// исходной командой. Все перенаправления, для которых shell копирует
+// дескрипторы, выполняются до отправки PID, потому что после нее может
+// действовать RLIMIT_NOFILE.
+const gateScript = `{ echo $$ >&%[1]d && read -r _; } <&%[2]d && exec %[1]d>&- %[2]d<&- && exec "$@"`
+
+// sysProcAttr возвращает атрибуты запуска процесса: отдельную группу
+// процессов и, если задан, пользователя.
+func (iso Isolation) sysProcAttr() *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	if iso.UID != 0 || iso.GID != 0 {
+		cred := &syscall.Credential{
+			Uid: uint32(os.Getuid()),
+			Gid: uint32(os.Getgid()),
+		}
+		if iso.UID != 0 {
+			cred.Uid = iso.UID
+		}
+		if iso.GID != 0 {
+			cred.Gid = iso.GID
+		}
+		attr.Credential = cred
+	}
+	return attr
+}
+
+// gate откладывает выполнение cmd до применения ограничений ресурсов и
+// помещения в группу cgroup. Если применять их после запуска, процесс успел
+// бы выделить память или запустить дочерние процессы вне группы. Процесс
+// запускается через /bin/sh, который сообщает свой PID и ждет, пока
+// ограничения будут применены к нему, после чего заменяется исходной
+// командой через exec, сохраняя PID, ограничения и группу.
+func (iso Isolation) gate(cmd *exec.Cmd) (*isolationGate, error) {
+	if iso.MaxAddressSpace == 0 && iso.MaxOpenFiles == 0 &&
+		iso.MaxCPUTime == 0 && iso.Cgroup == "" {
+		return nil, nil
+	}
+	// Ошибка поиска команды иначе проявилась бы только в обертке.
+	path, err := exec.LookPath(cmd.Path)
+	if err != nil {
+		return nil, err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	goR, goW, err := os.Pipe()
+	if err != nil {
+		readyR.Close()
+		readyW.Close()
+		return nil, err
+	}
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, readyW, goR)
+	cmd.Args = append(
+		[]string{"sh", "-c", fmt.Sprintf(gateScript, fd, fd+1), "corerunner", path},
+		cmd.Args[1:]...,
+	)
+	cmd.Path = "/bin/sh"
+	g := &isolationGate{child: []*os.File{readyW, goR}, res: make(chan error, 1)}
+	go func() {
+		defer readyR.Close()
+		defer goW.Close()
+		var pid int
+		if _, err := fmt.Fscan(readyR, &pid); err != nil {
+			g.res <- fmt.Errorf("could not get worker PID: %w", err)
+			return
+		}
+		err := iso.apply(pid)
+		if err == nil {
+			_, err = goW.Write([]byte("\n"))
+		}
+		// При ошибке закрытый goW завершает обертку.
+		g.res <- err
+	}()
+	return g, nil
+}
+
+// chownProcess передает файл path пользователю, от имени которого будет
+// запущен cmd, если он задан.
+func chownProcess(path string, cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil || cmd.SysProcAttr.Credential == nil {
+		return nil
+	}
+	cred := cmd.SysProcAttr.Credential
+	return os.Chown(path, int(cred.Uid), int(cred.Gid))
+}
+
+// apply устанавливает ограничения ресурсов процессу pid и помещает его в
+// группу cgroup. Вызывается до exec команды процесса (см. gate).
+func (iso Isolation) apply(pid int) error {
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_AS, iso.MaxAddressSpace},
+		{syscall.RLIMIT_NOFILE, iso.MaxOpenFiles},
+		{syscall.RLIMIT_CPU, uint64(iso.MaxCPUTime.Seconds())},
+	}
+	for _, l := range limits {
+		if l.value == 0 {
+			continue
+		}
+		// Мягкое и жесткое ограничения совпадают, чтобы процесс не мог
+		// их поднять.
+		lim := syscall.Rlimit{Cur: l.value, Max: l.value}
+		if err := prlimit(pid, l.resource, &lim); err != nil {
+			return fmt.Errorf("could not set rlimit %d: %w", l.resource, err)
+		}
+	}
+	if iso.Cgroup != "" {
+		err := os.WriteFile(
+			filepath.Join(iso.Cgroup, "cgroup.procs"),
+			[]byte(strconv.Itoa(pid)),
+			0644,
+		)
+		if err != nil {
+			return fmt.Errorf("could not join cgroup: %w", err)
+		}
+	}
+	return nil
+}
+
+// prlimit устанавливает ограничение ресурса resource другому процессу. В
+// пакете syscall нет обертки для этого системного вызова.
+func prlimit(pid int, resource int, lim *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(
+		syscall.SYS_PRLIMIT64,
+		uintptr(pid),
+		uintptr(resource),
+		uintptr(unsafe.Pointer(lim)),
+		0, 0, 0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// removeCgroup удаляет группу cgroup после завершения всех процессов.
+func (iso Isolation) removeCgroup() error {
+	if iso.Cgroup == "" {
+		return nil
+	}
+	err := os.Remove(iso.Cgroup)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// setupCgroup создает группу cgroup и устанавливает ее ограничения.
+func (iso Isolation) setupCgroup() error {
+	if iso.Cgroup == "" {
+		return nil
+	}
+	if err := os.MkdirAll(iso.Cgroup, 0755); err != nil {
+		return err
+	}
+	// Контроллеры должны быть включены в родительской группе. Ошибку не
+	// проверяем: они могут быть уже включены, а если их нет, то ошибкой
+	// завершится запись ограничений ниже.
+	os.WriteFile(
+		filepath.Join(filepath.Dir(iso.Cgroup), "cgroup.subtree_control"),
+		[]byte("+memory +cpu"),
+		0644,
+	)
+	if iso.CgroupMemoryMax > 0 {
+		err := os.WriteFile(
+			filepath.Join(iso.Cgroup, "memory.max"),
+			[]byte(strconv.FormatUint(iso.CgroupMemoryMax, 10)),
+			0644,
+		)
+		if err != nil {
+			return fmt.Errorf("could not set memory.max: %w", err)
+		}
+	}
+	if iso.CgroupCPUMax > 0 {
+		quota := int(iso.CgroupCPUMax * cgroupCPUPeriod)
+		err := os.WriteFile(
+			filepath.Join(iso.Cgroup, "cpu.max"),
+			[]byte(fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)),
+			0644,
+		)
+		if err != nil {
+			return fmt.Errorf("could not set cpu.max: %w", err)
+		}
+	}
+	return nil
+}
+
+// killProcess убивает процесс p вместе со всей его группой процессов.
+func killProcess(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGKILL); err == nil {
+		return nil
+	}
+	// Процесс мог не успеть создать свою группу.
+	return p.Kill()
+}
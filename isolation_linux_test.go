@@ -0,0 +1,32 @@
+package corerunner
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestIsolationGate(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "ulimit -n")
+	g, err := Isolation{MaxOpenFiles: 64}.gate(cmd)
+	if err != nil {
+		t.Fatalf("could not gate command: %s", err)
+	}
+	out := &strings.Builder{}
+	cmd.Stdout = out
+	err = cmd.Start()
+	g.started()
+	if err != nil {
+		t.Fatalf("could not start command: %s", err)
+	}
+	if err := g.wait(); err != nil {
+		t.Fatalf("could not apply limits: %s", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("command failed: %s", err)
+	}
+	// Ограничение действует уже при запуске команды.
+	if out.String() != "64\n" {
+		t.Fatalf("command started with open files limit %q", out.String())
+	}
+}
@@ -0,0 +1,39 @@
+//go:build !linux
+
+package corerunner
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func (iso Isolation) sysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func chownProcess(path string, cmd *exec.Cmd) error {
+	return nil
+}
+
+func (iso Isolation) gate(cmd *exec.Cmd) (*isolationGate, error) {
+	if iso.enabled() {
+		return nil, errIsolationUnsupported
+	}
+	return nil, nil
+}
+
+func (iso Isolation) removeCgroup() error {
+	return nil
+}
+
+func (iso Isolation) setupCgroup() error {
+	if iso.Cgroup != "" {
+		return errIsolationUnsupported
+	}
+	return nil
+}
+
+func killProcess(p *os.Process) error {
+	return p.Kill()
+}
@@ -1,7 +1,6 @@
 package jobs
 
 import (
-	"bytes"
 	"fmt"
 	"time"
 
@@ -29,8 +28,9 @@ func (j *Pool) Call(
 		Payload: payload,
 		Timeout: uint64(timeout.Milliseconds()),
 	}
-	buf := bytes.NewBuffer([]byte{})
-	buf.Grow(4096)
+	// Буфер нужен до ответа воркера, который читает из него задачу.
+	buf := runner.GetBuffer()
+	defer runner.PutBuffer(buf)
 	err := req.Write(buf)
 	if err != nil {
 		return nil, fmt.Errorf("job: serialization error: %s", err)
@@ -0,0 +1,248 @@
+package corerunner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Lane -- дорожка очереди пула со своим весом и ограничениями. Если у пула
+// заданы дорожки (Pool.Lanes), то каждая дорожка получает отдельную очередь, а
+// свободные воркеры получают задачи из дорожек пропорционально их весам
+// (взвешенный циклический алгоритм), поэтому всплеск задач в одной дорожке не
+// задерживает остальные.
+type Lane struct {
+	Name string
+	// Вес дорожки. Дорожка с весом 3 получает втрое больше свободных
+	// воркеров, чем дорожка с весом 1, если в обеих есть задачи. По
+	// умолчанию 1.
+	Weight int
+	// Максимальное количество задач в очереди дорожки. Если очередь
+	// заполнена, возвращается ErrQueueFull. При 0 используется
+	// Pool.MaxQueue.
+	MaxQueue int
+	// Максимальное количество задач дорожки, выполняемых одновременно. При
+	// 0 не ограничивается.
+	MaxWorkers int
+}
+
+// Снимок состояния дорожки.
+type LaneStats struct {
+	Name string
+	// Количество задач в очереди дорожки и выполняемых задач.
+	Queued  int
+	Running int
+}
+
+type laneKey struct{}
+
+// WithLane возвращает контекст, задачи с которым попадают в дорожку name (см.
+// Lane). Задачи без дорожки или с неизвестной дорожкой попадают в первую
+// дорожку пула.
+func WithLane(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, laneKey{}, name)
+}
+
+// Состояние дорожки в планировщике.
+type lane struct {
+	Lane
+	queue chan WorkerJob
+	// Количество задач в очереди без учета получивших ErrQueueTimeout.
+	depth atomic.Int64
+	// Количество выполняемых задач дорожки.
+	running int
+	// Текущий вес для плавного взвешенного циклического выбора.
+	current int
+}
+
+// Планировщик, распределяющий задачи из дорожек по воркерам. Отправляет
+// задачи в общую очередь пула без буфера, поэтому следующая задача
+// выбирается только тогда, когда ее готов взять воркер.
+type scheduler struct {
+	lanes  []*lane
+	byName map[string]*lane
+	out    chan WorkerJob
+	mu     sync.Mutex
+	// Сигнал о новой задаче или освобождении места в дорожке.
+	wake chan struct{}
+	// Закрывается после завершения планировщика.
+	done chan struct{}
+	// Закрывается, когда оставшиеся задачи некому выполнить.
+	abort     chan struct{}
+	abortOnce sync.Once
+}
+
+// newScheduler создает планировщик дорожек lanes, отправляющий задачи в out.
+// Размер очередей дорожек без ограничений -- capacity.
+func newScheduler(
+	lanes []Lane, maxQueue int, capacity int, out chan WorkerJob,
+) (*scheduler, error) {
+	s := &scheduler{
+		byName: make(map[string]*lane),
+		out:    out,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		abort:  make(chan struct{}),
+	}
+	for _, cfg := range lanes {
+		if _, ok := s.byName[cfg.Name]; ok {
+			return nil, fmt.Errorf("duplicate lane %q", cfg.Name)
+		}
+		if cfg.Weight <= 0 {
+			cfg.Weight = 1
+		}
+		if cfg.MaxQueue <= 0 {
+			cfg.MaxQueue = maxQueue
+		}
+		// Задачи, получившие ErrQueueTimeout, не учитываются в
+		// MaxQueue, но занимают место в канале, пока их не отбросит
+		// планировщик.
+		size := cfg.MaxQueue + capacity
+		l := &lane{Lane: cfg, queue: make(chan WorkerJob, size)}
+		s.lanes = append(s.lanes, l)
+		s.byName[cfg.Name] = l
+	}
+	return s, nil
+}
+
+// lane возвращает дорожку для задачи с контекстом ctx.
+func (s *scheduler) lane(ctx context.Context) *lane {
+	name, _ := ctx.Value(laneKey{}).(string)
+	if l, ok := s.byName[name]; ok {
+		return l
+	}
+	return s.lanes[0]
+}
+
+// notify будит планировщик.
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run отправляет задачи воркерам, пока не будет закрыт stop. После этого
+// отправляет оставшиеся в дорожках задачи и завершается. После cancel
+// завершает оставшиеся задачи с ErrPoolStopped.
+func (s *scheduler) run(stop chan struct{}) {
+	defer close(s.done)
+	for {
+		if job, ok := s.next(); ok {
+			select {
+			case s.out <- job:
+			case <-s.abort:
+				job.fail(ErrPoolStopped)
+				s.failAll()
+				return
+			}
+			continue
+		}
+		select {
+		case <-s.wake:
+		case <-s.abort:
+			s.failAll()
+			return
+		case <-stop:
+			if s.empty() {
+				return
+			}
+			// Дальше ждем только освобождения места в дорожках.
+			stop = nil
+		}
+		if stop == nil && s.empty() {
+			return
+		}
+	}
+}
+
+// cancel прерывает передачу оставшихся задач воркерам, например, если
+// воркеров не осталось.
+func (s *scheduler) cancel() {
+	s.abortOnce.Do(func() { close(s.abort) })
+}
+
+// failAll завершает все задачи дорожек с ErrPoolStopped.
+func (s *scheduler) failAll() {
+	for _, l := range s.lanes {
+		for len(l.queue) > 0 {
+			job := <-l.queue
+			job.fail(ErrPoolStopped)
+		}
+	}
+}
+
+// next выбирает следующую задачу плавным взвешенным циклическим алгоритмом
+// среди дорожек, в которых есть задачи и не превышен MaxWorkers.
+func (s *scheduler) next() (WorkerJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		var best *lane
+		total := 0
+		for _, l := range s.lanes {
+			if len(l.queue) == 0 ||
+				(l.MaxWorkers > 0 && l.running >= l.MaxWorkers) {
+				continue
+			}
+			l.current += l.Weight
+			total += l.Weight
+			if best == nil || l.current > best.current {
+				best = l
+			}
+		}
+		if best == nil {
+			return WorkerJob{}, false
+		}
+		best.current -= total
+		job := <-best.queue
+		// Задача уже получила ErrQueueTimeout или ее отменили.
+		if job.state != nil && job.state.claimed.Load() {
+			continue
+		}
+		best.running++
+		job.release = func() { s.release(best) }
+		return job, true
+	}
+}
+
+// release учитывает завершение задачи дорожки l.
+func (s *scheduler) release(l *lane) {
+	s.mu.Lock()
+	l.running--
+	s.mu.Unlock()
+	s.notify()
+}
+
+// empty сообщает, что во всех дорожках нет задач.
+func (s *scheduler) empty() bool {
+	for _, l := range s.lanes {
+		if len(l.queue) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// stats возвращает снимок состояния дорожек, а также общее количество задач
+// в их очередях и общий размер очередей.
+func (s *scheduler) stats() (lanes []LaneStats, queued int, capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.lanes {
+		n := int(l.depth.Load())
+		lanes = append(lanes, LaneStats{
+			Name:    l.Name,
+			Queued:  n,
+			Running: l.running,
+		})
+		queued += n
+		if l.MaxQueue > 0 {
+			capacity += l.MaxQueue
+		} else {
+			capacity += cap(l.queue)
+		}
+	}
+	return lanes, queued, capacity
+}
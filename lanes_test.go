@@ -0,0 +1,62 @@
+package corerunner
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSchedulerWeights(t *testing.T) {
+	s, err := newScheduler([]Lane{
+		{Name: "low"},
+		{Name: "high", Weight: 3},
+		{Name: "single", MaxWorkers: 1},
+	}, 0, 16, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"low", "high", "single"} {
+		l := s.lane(WithLane(context.Background(), name))
+		for i := 0; i < 8; i++ {
+			l.queue <- WorkerJob{}
+		}
+	}
+	picked := map[string]int{}
+	for i := 0; i < 9; i++ {
+		if _, ok := s.next(); !ok {
+			t.Fatalf("no job picked on step %d", i)
+		}
+		for _, l := range s.lanes {
+			if l.running > picked[l.Name] {
+				picked[l.Name] = l.running
+			}
+		}
+	}
+	if picked["single"] != 1 || picked["high"] != 6 || picked["low"] != 2 {
+		t.Fatalf("lanes are not weighted: %v", picked)
+	}
+	if l := s.lane(context.Background()); l.Name != "low" {
+		t.Fatalf("job without lane went to %q", l.Name)
+	}
+}
+
+func TestLanesStopWithoutWorkers(t *testing.T) {
+	p := &Pool{Lanes: []Lane{{Name: "default"}}, MaxQueue: 10}
+	if err := p.Start(nil, 0, nil); err != nil {
+		t.Fatalf("could not start pool: %s", err)
+	}
+	res := p.Send(nil, time.Second)
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("pool without workers does not stop")
+	}
+	if r := <-res; r.Err != ErrPoolStopped {
+		t.Fatalf("queued job got %v", r.Err)
+	}
+}
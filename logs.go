@@ -0,0 +1,351 @@
+package corerunner
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Максимальная длина записи лога процесса (в байтах) по умолчанию.
+	// Более длинные строки обрезаются.
+	DefaultLogMaxLine = 8192
+	// Время, в течение которого продолжение многострочной записи (например,
+	// трассировки стека PHP) приклеивается к ней.
+	logJoinDelay = 50 * time.Millisecond
+)
+
+// Запись лога запущенного процесса, полученная из его stdout или stderr.
+type LogRecord struct {
+	Time time.Time
+	// Название пула (Pool.Name).
+	Pool string
+	PID  int
+	// Идентификатор запроса, выполнявшегося процессом, если он известен
+	// (см. WithRequestID).
+	Request string
+	// Откуда прочитана запись: stdout или stderr.
+	Stream string
+	// Уровень в нижнем регистре, например, error, или пустая строка, если
+	// его не удалось определить.
+	Level   string
+	Message string
+	// Контекст записи, если процесс пишет логи в JSON (например,
+	// JsonFormatter в Monolog).
+	Context map[string]any
+}
+
+// LogSink получает записи логов запущенных процессов. Вызывается конкурентно.
+type LogSink interface {
+	Log(rec LogRecord)
+}
+
+// TextLogSink выводит записи логов текстом в Out или, если Out == nil, в
+// стандартный логгер.
+type TextLogSink struct {
+	Out io.Writer
+}
+
+func (s TextLogSink) Log(rec LogRecord) {
+	logger := log.Default()
+	if s.Out != nil {
+		logger = log.New(s.Out, "", log.LstdFlags)
+	}
+	tags := []string{}
+	if rec.Pool != "" {
+		tags = append(tags, rec.Pool)
+	}
+	if rec.Request != "" {
+		tags = append(tags, "request "+rec.Request)
+	}
+	prefix := fmt.Sprintf("PID %d", rec.PID)
+	if len(tags) > 0 {
+		prefix += " (" + strings.Join(tags, ", ") + ")"
+	}
+	msg := rec.Message
+	if rec.Level != "" {
+		msg = strings.ToUpper(rec.Level) + ": " + msg
+	}
+	if len(rec.Context) > 0 {
+		ctx, _ := json.Marshal(rec.Context)
+		msg += " " + string(ctx)
+	}
+	logger.Printf("%s: %s", prefix, msg)
+}
+
+// JSONLogSink выводит записи логов в Out (по умолчанию в stderr) в формате
+// JSON Lines.
+type JSONLogSink struct {
+	Out io.Writer
+}
+
+func (s JSONLogSink) Log(rec LogRecord) {
+	out := s.Out
+	if out == nil {
+		out = os.Stderr
+	}
+	b, err := json.Marshal(struct {
+		Time    time.Time      `json:"time"`
+		Pool    string         `json:"pool,omitempty"`
+		PID     int            `json:"pid"`
+		Request string         `json:"request,omitempty"`
+		Stream  string         `json:"stream"`
+		Level   string         `json:"level,omitempty"`
+		Message string         `json:"message"`
+		Context map[string]any `json:"context,omitempty"`
+	}{
+		rec.Time, rec.Pool, rec.PID, rec.Request, rec.Stream, rec.Level,
+		rec.Message, rec.Context,
+	})
+	if err != nil {
+		log.Printf("PID %d: log encoding error: %s", rec.PID, err)
+		return
+	}
+	// Запись одним вызовом Write, чтобы строки разных процессов не
+	// перемешивались.
+	out.Write(append(b, '\n'))
+}
+
+type requestIDKey struct{}
+
+// WithRequestID возвращает контекст с идентификатором запроса id. Если
+// контекст передан в SendContext, то id добавляется к записям лога процесса,
+// выполняющего запрос. В режиме мультиплексирования процесс выполняет
+// несколько запросов одновременно, поэтому записи не помечаются.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID возвращает идентификатор запроса из контекста ctx.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Захват вывода одного процесса.
+type procLog struct {
+	sink LogSink
+	pool string
+	pid  int
+	max  int
+	// Возвращает идентификатор выполняемого сейчас запроса.
+	request func() string
+}
+
+// capture построчно читает вывод процесса из r и передает его в sink, пока r
+// не будет закрыт. Строки продолжения многострочных записей приклеиваются к
+// ним.
+func (l *procLog) capture(r io.ReadCloser, stream string) {
+	defer r.Close()
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		rd := bufio.NewReader(r)
+		for {
+			line, err := readLogLine(rd, l.max)
+			if line != "" {
+				lines <- line
+			}
+			if err != nil {
+				// Pipe закрывается при завершении процесса, это не
+				// ошибка.
+				if err != io.EOF && !errors.Is(err, os.ErrClosed) {
+					log.Printf("PID %d: logging error: %s", l.pid, err)
+				}
+				return
+			}
+		}
+	}()
+
+	var pending []string
+	var request string
+	flush := time.NewTimer(logJoinDelay)
+	flush.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if len(pending) > 0 && ok && isContinuation(line) {
+				pending = append(pending, line)
+				resetTimer(flush, logJoinDelay)
+				continue
+			}
+			if len(pending) > 0 {
+				l.emit(strings.Join(pending, "\n"), stream, request)
+			}
+			if !ok {
+				flush.Stop()
+				return
+			}
+			pending = []string{line}
+			// Запрос запоминается по первой строке, к концу
+			// трассировки процесс может взяться за следующий.
+			request = l.request()
+			resetTimer(flush, logJoinDelay)
+		case <-flush.C:
+			if len(pending) > 0 {
+				l.emit(strings.Join(pending, "\n"), stream, request)
+				pending = nil
+			}
+		}
+	}
+}
+
+// resetTimer перезапускает таймер t, отбрасывая несработавшее значение.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// emit разбирает запись лога msg и передает ее в sink.
+func (l *procLog) emit(msg string, stream string, request string) {
+	rec := parseLogLine(truncate(msg, l.max))
+	rec.Time = time.Now()
+	rec.Pool = l.pool
+	rec.PID = l.pid
+	rec.Request = request
+	rec.Stream = stream
+	l.sink.Log(rec)
+}
+
+// readLogLine читает из rd строку без перевода строки. От строк длиннее max
+// байт остается только начало, остальное пропускается.
+func readLogLine(rd *bufio.Reader, max int) (string, error) {
+	var b []byte
+	cut := false
+	for {
+		chunk, err := rd.ReadSlice('\n')
+		n := min(len(chunk), max-len(b))
+		b = append(b, chunk[:n]...)
+		if strings.TrimRight(string(chunk[n:]), "\r\n") != "" {
+			cut = true
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		line := strings.TrimRight(string(b), "\r\n")
+		if cut {
+			line += "..."
+		}
+		return line, err
+	}
+}
+
+// truncate обрезает s до max байт.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "..."
+}
+
+// isContinuation сообщает, что строка продолжает предыдущую запись, например,
+// трассировку стека PHP.
+func isContinuation(line string) bool {
+	if line == "" {
+		return false
+	}
+	if line[0] == ' ' || line[0] == '\t' {
+		return true
+	}
+	if len(line) > 1 && line[0] == '#' && line[1] >= '0' && line[1] <= '9' {
+		return true
+	}
+	return strings.HasPrefix(line, "Stack trace:") ||
+		strings.HasPrefix(line, "Next ")
+}
+
+// Уровни ошибок PHP, выводимых в stderr.
+var phpLevels = []struct{ prefix, level string }{
+	{"PHP Fatal error:", "error"},
+	{"PHP Parse error:", "error"},
+	{"PHP Warning:", "warning"},
+	{"PHP Notice:", "notice"},
+	{"PHP Deprecated:", "notice"},
+}
+
+// Числовые уровни Monolog.
+var monologLevels = map[float64]string{
+	100: "debug",
+	200: "info",
+	250: "notice",
+	300: "warning",
+	400: "error",
+	500: "critical",
+	550: "alert",
+	600: "emergency",
+}
+
+// parseLogLine определяет уровень, сообщение и контекст записи лога. Записи в
+// JSON разбираются в формате Monolog, у остальных уровень определяется по
+// префиксу ошибок PHP.
+func parseLogLine(line string) LogRecord {
+	rec := LogRecord{Message: line}
+	var m map[string]any
+	if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &m) == nil {
+		msg, ok := m["message"].(string)
+		if !ok {
+			msg, ok = m["msg"].(string)
+		}
+		if ok {
+			rec.Message = msg
+			rec.Level = jsonLevel(m)
+			rec.Context = jsonContext(m)
+			return rec
+		}
+	}
+	for _, l := range phpLevels {
+		if strings.HasPrefix(line, l.prefix) {
+			rec.Level = l.level
+			break
+		}
+	}
+	return rec
+}
+
+func jsonLevel(m map[string]any) string {
+	if l, ok := m["level_name"].(string); ok {
+		return strings.ToLower(l)
+	}
+	switch l := m["level"].(type) {
+	case string:
+		return strings.ToLower(l)
+	case float64:
+		return monologLevels[l]
+	}
+	return ""
+}
+
+// jsonContext собирает контекст записи: поля context и extra Monolog и
+// название канала.
+func jsonContext(m map[string]any) map[string]any {
+	ctx := map[string]any{}
+	if extra, ok := m["extra"].(map[string]any); ok {
+		for k, v := range extra {
+			ctx[k] = v
+		}
+	}
+	if c, ok := m["context"].(map[string]any); ok {
+		for k, v := range c {
+			ctx[k] = v
+		}
+	}
+	if ch, ok := m["channel"].(string); ok {
+		ctx["channel"] = ch
+	}
+	if len(ctx) == 0 {
+		return nil
+	}
+	return ctx
+}
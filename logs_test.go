@@ -0,0 +1,55 @@
+package corerunner
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type sliceSink struct {
+	mu   sync.Mutex
+	recs []LogRecord
+}
+
+func (s *sliceSink) Log(rec LogRecord) {
+	s.mu.Lock()
+	s.recs = append(s.recs, rec)
+	s.mu.Unlock()
+}
+
+func TestLogCapture(t *testing.T) {
+	out := strings.Join([]string{
+		`{"message":"user logged in","context":{"id":7},"level":200,"channel":"app","extra":{}}`,
+		"PHP Fatal error:  Uncaught Exception: boom in /app/index.php:3",
+		"Stack trace:",
+		"#0 {main}",
+		"  thrown in /app/index.php on line 3",
+		"echo " + strings.Repeat("x", 300),
+	}, "\n")
+	sink := &sliceSink{}
+	l := &procLog{
+		sink: sink, pool: "http", pid: 42, max: 128,
+		request: func() string { return "r1" },
+	}
+	l.capture(io.NopCloser(strings.NewReader(out)), "stderr")
+	if len(sink.recs) != 3 {
+		t.Fatalf("expected 3 records, got %d: %v", len(sink.recs), sink.recs)
+	}
+	rec := sink.recs[0]
+	if rec.Level != "info" || rec.Message != "user logged in" ||
+		rec.Context["id"] != float64(7) || rec.Context["channel"] != "app" {
+		t.Fatalf("JSON record is not parsed: %+v", rec)
+	}
+	if rec.PID != 42 || rec.Pool != "http" || rec.Request != "r1" {
+		t.Fatalf("record is not tagged: %+v", rec)
+	}
+	if rec := sink.recs[1]; rec.Level != "error" ||
+		!strings.HasPrefix(rec.Message, "PHP Fatal error:") ||
+		!strings.HasSuffix(rec.Message, "\n  thrown in /app/index.php on line 3") {
+		t.Fatalf("trace is not joined: %+v", rec)
+	}
+	if rec := sink.recs[2]; rec.Message != "echo "+strings.Repeat("x", 123)+"..." {
+		t.Fatalf("long line is not truncated: %q", rec.Message)
+	}
+}
@@ -0,0 +1,121 @@
+package corerunner
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Период проверки памяти процессов по умолчанию.
+	DefaultMemoryCheckInterval = time.Second
+)
+
+// watchMemory периодически проверяет занимаемую процессами пула память и
+// перезапускает воркеры, превысившие MemorySoftLimit или MemoryHardLimit.
+// Работает до закрытия done.
+func (p *Pool) watchMemory(done chan struct{}) {
+	interval := p.MemoryCheckInterval
+	if interval <= 0 {
+		interval = DefaultMemoryCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		for _, wrk := range p.workers() {
+			p.checkMemory(wrk)
+		}
+	}
+}
+
+func (p *Pool) checkMemory(wrk *Worker) {
+	proc := wrk.running.Load()
+	if proc == nil {
+		return
+	}
+	pid := proc.pid
+	mem, err := readRSS(pid)
+	if err != nil {
+		// Процесс мог завершиться между получением PID и чтением
+		// статистики, это не ошибка.
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("PID %d: could not read memory usage: %s", pid, err)
+		}
+		return
+	}
+	limit, hard := p.memoryLimit(mem)
+	switch {
+	case limit == 0:
+	case hard:
+		log.Printf(
+			"PID %d: memory usage %d KB exceeds hard limit %d KB",
+			pid, mem/1024, limit/1024,
+		)
+		wrk.killOrRecycle(proc, "hard memory limit")
+	case wrk.requestRecycle("soft memory limit"):
+		log.Printf(
+			"PID %d: memory usage %d KB exceeds soft limit %d KB",
+			pid, mem/1024, limit/1024,
+		)
+	}
+}
+
+// memoryLimit возвращает ограничение, превышенное процессом с резидентной
+// памятью mem, или 0, если ограничения не превышены. hard сообщает, что
+// превышено MemoryHardLimit.
+func (p *Pool) memoryLimit(mem uint64) (limit uint64, hard bool) {
+	switch {
+	case p.MemoryHardLimit > 0 && mem >= p.MemoryHardLimit:
+		return p.MemoryHardLimit, true
+	case p.MemorySoftLimit > 0 && mem >= p.MemorySoftLimit:
+		return p.MemorySoftLimit, false
+	}
+	return 0, false
+}
+
+// readRSS возвращает размер резидентной памяти (VmRSS) процесса pid в
+// байтах. Работает только в Linux.
+func readRSS(pid int) (uint64, error) {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseRSS(f)
+}
+
+// parseRSS находит строку вида "VmRSS:    1234 kB" в содержимом
+// /proc/<pid>/status и возвращает значение в байтах.
+func parseRSS(r io.Reader) (uint64, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := s.Text()
+		if !strings.HasPrefix(l, "VmRSS:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(l, "VmRSS:"))
+		if len(fields) != 2 || fields[1] != "kB" {
+			return 0, errors.New("unexpected VmRSS format: " + l)
+		}
+		kb, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	// У зомби-процессов строки VmRSS нет.
+	return 0, nil
+}
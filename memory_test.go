@@ -0,0 +1,68 @@
+package corerunner
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseRSS(t *testing.T) {
+	status := "Name:\tphp\nVmPeak:\t  300000 kB\nVmRSS:\t   12345 kB\nThreads:\t1\n"
+	got, err := parseRSS(strings.NewReader(status))
+	if err != nil {
+		t.Fatalf("could not parse VmRSS: %s", err)
+	}
+	if want := uint64(12345 * 1024); got != want {
+		t.Fatalf("parsed VmRSS does not match: %d and %d", want, got)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	p := &Pool{MemorySoftLimit: 100, MemoryHardLimit: 200}
+	cases := []struct {
+		mem   uint64
+		limit uint64
+		hard  bool
+	}{
+		{99, 0, false},
+		{100, 100, false},
+		{199, 100, false},
+		{200, 200, true},
+		{500, 200, true},
+	}
+	for _, c := range cases {
+		if limit, hard := p.memoryLimit(c.mem); limit != c.limit || hard != c.hard {
+			t.Fatalf("limit for %d does not match: %d %t", c.mem, limit, hard)
+		}
+	}
+	if limit, _ := (&Pool{}).memoryLimit(1 << 40); limit != 0 {
+		t.Fatal("memory must not be limited by default")
+	}
+
+	srv, cli := net.Pipe()
+	proc := &process{conn: newExtConn(srv)}
+	wrk := NewWorker(nil)
+	wrk.proc = proc
+	// Простаивающий процесс штатно перезапускается.
+	wrk.killOrRecycle(proc, "soft memory limit")
+	if reason := <-wrk.recycleCh; reason != "soft memory limit" {
+		t.Fatalf("unexpected recycle reason %q", reason)
+	}
+	// Уже замененный процесс не убивается.
+	wrk.setState(WorkerBusy)
+	old := &process{conn: newExtConn(cli)}
+	defer old.kill()
+	wrk.killOrRecycle(old, "hard memory limit")
+	select {
+	case <-old.conn.(*extConn).closed:
+		t.Fatal("replaced process is killed")
+	default:
+	}
+	// Процесс, выполняющий задачу, убивается.
+	wrk.killOrRecycle(proc, "hard memory limit")
+	select {
+	case <-proc.conn.(*extConn).closed:
+	default:
+		t.Fatal("busy process is not killed")
+	}
+}
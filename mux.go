@@ -0,0 +1,319 @@
+// Режим мультиплексирования позволяет воркеру, использующему Fibers или
+// event loop, выполнять несколько задач одновременно.
+//
+// Воркер сообщает о поддержке режима в строке готовности, указывая
+// максимальное количество одновременно выполняемых задач:
+// ok mux=8\n
+//
+// Go отвечает строкой с согласованным ограничением, которое не больше
+// заявленного воркером и Worker.Concurrency (см. handshake.go):
+// mux=4\n
+//
+// После этого в версии 1 протокола каждое сообщение в обе стороны
+// предваряется идентификатором запроса, по которому Go сопоставляет ответы с
+// запросами. Ответы могут приходить в любом порядке:
+// [id] [len(msg)]\n[msg]
+//
+// Остановка процесса, как и в обычном режиме, -- пустая строка. В версии 2
+// идентификатор запроса содержится в заголовке кадра (см. frame.go), а процесс
+// может вызывать сервисы Go (см. services.go).
+package corerunner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Количество частей потокового ответа, которые могут ждать отправки
+// получателю.
+const muxChunkBuffer = 16
+
+var (
+	errMuxClosed       = errors.New("worker connection closed")
+	errUnexpectedChunk = errors.New("unexpected chunk for non-streaming request")
+	errNoPong          = errors.New("no pong")
+)
+
+// Соединение с процессом в режиме мультиплексирования. Создается для каждого
+// запущенного процесса.
+type muxConn struct {
+	// Версия протокола.
+	proto int
+	read  *bufio.Reader
+	write *bufio.Writer
+	// Блокировка записи, общая с Worker.mu.
+	wmu *sync.Mutex
+	// Сервисы, доступные процессу.
+	services *Services
+	// Максимальный размер сообщения от процесса (см.
+	// Worker.MaxMessageSize).
+	limit int
+	// Свободные места для одновременных вызовов сервисов, по одному на
+	// задачу, которую может выполнять процесс (см. Worker.Concurrency).
+	calls chan struct{}
+	// Контекст вызовов сервисов, отменяется при завершении процесса.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Ожидающие ответа запросы.
+	pending map[uint64]*muxRequest
+	nextID  uint64
+	// Ошибка, с которой завершилось чтение ответов.
+	err error
+	mu  sync.Mutex
+}
+
+// Запрос, ожидающий ответа процесса.
+type muxRequest struct {
+	id  uint64
+	res chan *WorkerResult
+	// Части потокового ответа (frameChunk) или nil, если запрос не
+	// потоковый.
+	chunks chan []byte
+	// Закрывается, когда ответ перестают ждать.
+	done chan struct{}
+}
+
+func newMuxConn(
+	proto int,
+	read *bufio.Reader,
+	write *bufio.Writer,
+	wmu *sync.Mutex,
+	services *Services,
+	limit int,
+	concurrency int,
+) *muxConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &muxConn{
+		proto:    proto,
+		read:     read,
+		write:    write,
+		wmu:      wmu,
+		services: services,
+		limit:    limit,
+		calls:    make(chan struct{}, max(concurrency, 1)),
+		ctx:      ctx,
+		cancel:   cancel,
+		pending:  make(map[uint64]*muxRequest),
+	}
+}
+
+// send отправляет запрос процессу. Если stream = true, то процесс может
+// отправлять ответ частями, которые приходят в канал chunks запроса.
+func (c *muxConn) send(data []byte, stream bool) (*muxRequest, error) {
+	return c.request(frame{typ: frameRequest, data: data}, stream)
+}
+
+// ping проверяет, что процесс отвечает на framePing не дольше timeout.
+func (c *muxConn) ping(timeout time.Duration) error {
+	req, err := c.request(frame{typ: framePing}, false)
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-req.res:
+		return res.Err
+	case <-timer.C:
+		c.forget(req)
+		return fmt.Errorf("%w after %s", errNoPong, timeout)
+	}
+}
+
+// request отправляет процессу кадр f, ожидающий ответа, с новым
+// идентификатором.
+func (c *muxConn) request(f frame, stream bool) (*muxRequest, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	req := &muxRequest{
+		id:   c.nextID,
+		res:  make(chan *WorkerResult, 1),
+		done: make(chan struct{}),
+	}
+	if stream {
+		req.chunks = make(chan []byte, muxChunkBuffer)
+	}
+	c.pending[req.id] = req
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	f.id = req.id
+	err := c.writeFrame(f)
+	c.wmu.Unlock()
+	if err != nil {
+		c.forget(req)
+		return nil, err
+	}
+	return req, nil
+}
+
+// forget перестает ждать ответ на запрос, например, после таймаута.
+// Пришедший позже ответ будет отброшен.
+func (c *muxConn) forget(req *muxRequest) {
+	c.mu.Lock()
+	if c.pending[req.id] == req {
+		delete(c.pending, req.id)
+		close(req.done)
+	}
+	c.mu.Unlock()
+}
+
+// readLoop читает ответы процесса и передает их ожидающим запросам, пока
+// процесс не завершится.
+func (c *muxConn) readLoop() {
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			c.close(err)
+			return
+		}
+		if f.typ == frameCall && c.proto == protoV2 {
+			// Если все места заняты, процесс вызывает сервисы больше, чем
+			// выполняет задач, и чтение ждет завершения одного из вызовов.
+			c.calls <- struct{}{}
+			go func() {
+				defer func() { <-c.calls }()
+				c.call(f)
+			}()
+			continue
+		}
+		if f.typ != frameResponse && f.typ != frameChunk && f.typ != framePong {
+			c.close(fmt.Errorf("unexpected frame type %d", f.typ))
+			return
+		}
+		c.mu.Lock()
+		req := c.pending[f.id]
+		if req != nil && (f.typ != frameChunk || req.chunks == nil) {
+			delete(c.pending, f.id)
+			close(req.done)
+		}
+		c.mu.Unlock()
+		switch {
+		case req == nil:
+		case f.typ == framePong && f.flags&frameFlagError != 0:
+			req.res <- &WorkerResult{Err: errors.New(string(f.data))}
+		case f.typ == frameResponse && f.flags&frameFlagError != 0:
+			req.res <- &WorkerResult{
+				Err: fmt.Errorf("%w: %s", ErrJobFailed, f.data),
+			}
+		case f.typ != frameChunk:
+			req.res <- &WorkerResult{Res: f.data}
+		case req.chunks == nil:
+			req.res <- &WorkerResult{Err: errUnexpectedChunk}
+		default:
+			// Медленный получатель задерживает чтение остальных
+			// ответов процесса.
+			select {
+			case req.chunks <- f.data:
+			case <-req.done:
+			}
+		}
+	}
+}
+
+// call выполняет вызов сервиса процессом и отправляет ему ответ.
+func (c *muxConn) call(f frame) {
+	name, payload, _ := bytes.Cut(f.data, []byte("\n"))
+	res, err := c.services.Call(c.ctx, string(name), payload)
+	reply := frame{typ: frameReply, id: f.id, data: res}
+	if err != nil {
+		reply.flags = frameFlagError
+		reply.data = []byte(err.Error())
+	}
+	c.wmu.Lock()
+	err = c.writeFrame(reply)
+	c.wmu.Unlock()
+	if err != nil {
+		log.Printf("call %q reply error: %s", name, err)
+	}
+}
+
+// writeStop просит процесс штатно завершиться. Вызывается с захваченной
+// блокировкой wmu.
+func (c *muxConn) writeStop() error {
+	if c.proto == protoV2 {
+		return writeFrame(c.write, frame{typ: frameStop})
+	}
+	if _, err := c.write.WriteString("\n"); err != nil {
+		return err
+	}
+	return c.write.Flush()
+}
+
+func (c *muxConn) readFrame() (frame, error) {
+	if c.proto == protoV2 {
+		return readFrame(c.read, c.limit)
+	}
+	id, data, err := readMuxFrame(c.read, c.limit)
+	return frame{typ: frameResponse, id: id, data: data}, err
+}
+
+func (c *muxConn) writeFrame(f frame) error {
+	if c.proto == protoV2 {
+		return writeFrame(c.write, f)
+	}
+	return writeMuxFrame(c.write, f.id, f.data)
+}
+
+// close завершает все ожидающие запросы с ошибкой err.
+func (c *muxConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.cancel()
+	c.err = fmt.Errorf("%w: %s", errMuxClosed, err)
+	for id, req := range c.pending {
+		req.res <- &WorkerResult{Err: c.err}
+		delete(c.pending, id)
+		close(req.done)
+	}
+}
+
+func readMuxFrame(r *bufio.Reader, limit int) (uint64, []byte, error) {
+	l, err := r.ReadSlice('\n')
+	if err != nil {
+		return 0, nil, err
+	}
+	idStr, lnStr, ok := bytes.Cut(l[:len(l)-1], []byte(" "))
+	if !ok {
+		return 0, nil, fmt.Errorf("malformed frame header %q", l)
+	}
+	id, err := strconv.ParseUint(string(idStr), 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	ln, err := strconv.Atoi(string(lnStr))
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := readBody(r, ln, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, data, nil
+}
+
+func writeMuxFrame(w *bufio.Writer, id uint64, data []byte) error {
+	h := strconv.AppendUint(w.AvailableBuffer(), id, 10)
+	h = appendLen(append(h, ' '), len(data))
+	if _, err := w.Write(h); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
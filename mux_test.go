@@ -0,0 +1,199 @@
+package corerunner
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Процесс на другом конце muxConn.
+type muxProc struct {
+	proto int
+	r     *bufio.Reader
+	w     *bufio.Writer
+	out   *io.PipeWriter
+	// Прочитанные процессом кадры.
+	frames chan frame
+}
+
+// pipeMux возвращает соединение версии proto, связанное с процессом через
+// пару io.Pipe.
+func pipeMux(proto int, services *Services) (*muxConn, *muxProc) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := newMuxConn(proto, bufio.NewReader(outR), bufio.NewWriter(inW), &sync.Mutex{}, services, 0, 1)
+	go c.readLoop()
+	p := &muxProc{
+		proto:  proto,
+		r:      bufio.NewReader(inR),
+		w:      bufio.NewWriter(outW),
+		out:    outW,
+		frames: make(chan frame, 16),
+	}
+	go func() {
+		for {
+			f, err := p.read()
+			if err != nil {
+				close(p.frames)
+				return
+			}
+			p.frames <- f
+		}
+	}()
+	return c, p
+}
+
+func (p *muxProc) read() (frame, error) {
+	if p.proto == protoV2 {
+		return readFrame(p.r, 0)
+	}
+	id, data, err := readMuxFrame(p.r, 0)
+	return frame{typ: frameRequest, id: id, data: data}, err
+}
+
+func (p *muxProc) reply(f frame) error {
+	if p.proto == protoV2 {
+		return writeFrame(p.w, f)
+	}
+	return writeMuxFrame(p.w, f.id, f.data)
+}
+
+// result ждет ответ на запрос req.
+func result(t *testing.T, req *muxRequest) *WorkerResult {
+	t.Helper()
+	select {
+	case res := <-req.res:
+		return res
+	case <-time.After(time.Second):
+		t.Fatalf("no result for request %d", req.id)
+		return nil
+	}
+}
+
+func TestMuxConn(t *testing.T) {
+	cases := []struct {
+		name   string
+		protos []int
+		run    func(t *testing.T, c *muxConn, p *muxProc)
+	}{
+		{"out of order", []int{protoV1, protoV2}, func(t *testing.T, c *muxConn, p *muxProc) {
+			var reqs []*muxRequest
+			for _, data := range []string{"a", "b", "c"} {
+				req, err := c.send([]byte(data), false)
+				if err != nil {
+					t.Fatalf("could not send: %s", err)
+				}
+				reqs = append(reqs, req)
+			}
+			var frames []frame
+			for range reqs {
+				frames = append(frames, <-p.frames)
+			}
+			for i := len(frames) - 1; i >= 0; i-- {
+				f := frames[i]
+				p.reply(frame{typ: frameResponse, id: f.id, data: append(f.data, '!')})
+			}
+			for i, data := range []string{"a!", "b!", "c!"} {
+				if res := result(t, reqs[i]); res.Err != nil || string(res.Res) != data {
+					t.Fatalf("request %d got %q, %v instead of %q", i, res.Res, res.Err, data)
+				}
+			}
+		}},
+		{"ping timeout", []int{protoV2}, func(t *testing.T, c *muxConn, p *muxProc) {
+			if err := c.ping(10 * time.Millisecond); !errors.Is(err, errNoPong) {
+				t.Fatalf("unanswered ping got %v", err)
+			}
+			if f := <-p.frames; f.typ != framePing {
+				t.Fatalf("unexpected frame type %d", f.typ)
+			}
+			c.mu.Lock()
+			n := len(c.pending)
+			c.mu.Unlock()
+			if n != 0 {
+				t.Fatalf("timed out ping is still pending")
+			}
+		}},
+		{"late reply", []int{protoV1, protoV2}, func(t *testing.T, c *muxConn, p *muxProc) {
+			late, _ := c.send([]byte("late"), false)
+			c.forget(late)
+			req, _ := c.send([]byte("next"), false)
+			for _, f := range []frame{<-p.frames, <-p.frames} {
+				p.reply(frame{typ: frameResponse, id: f.id, data: f.data})
+			}
+			if res := result(t, req); string(res.Res) != "next" {
+				t.Fatalf("request after forgotten one got %q, %v", res.Res, res.Err)
+			}
+			select {
+			case res := <-late.res:
+				t.Fatalf("forgotten request got %q", res.Res)
+			case <-late.done:
+			}
+		}},
+		{"job failed", []int{protoV2}, func(t *testing.T, c *muxConn, p *muxProc) {
+			req, _ := c.send([]byte("job"), false)
+			f := <-p.frames
+			p.reply(frame{typ: frameResponse, flags: frameFlagError, id: f.id, data: []byte("oops")})
+			if res := result(t, req); !errors.Is(res.Err, ErrJobFailed) {
+				t.Fatalf("failed job got %q, %v", res.Res, res.Err)
+			}
+		}},
+		{"close", []int{protoV1, protoV2}, func(t *testing.T, c *muxConn, p *muxProc) {
+			a, _ := c.send([]byte("a"), false)
+			b, _ := c.send([]byte("b"), true)
+			<-p.frames
+			<-p.frames
+			p.out.Close()
+			for _, req := range []*muxRequest{a, b} {
+				if res := result(t, req); !errors.Is(res.Err, errMuxClosed) {
+					t.Fatalf("pending request got %q, %v", res.Res, res.Err)
+				}
+			}
+			if _, err := c.send([]byte("c"), false); !errors.Is(err, errMuxClosed) {
+				t.Fatalf("request after close got %v", err)
+			}
+		}},
+	}
+	for _, tc := range cases {
+		for _, proto := range tc.protos {
+			c, p := pipeMux(proto, nil)
+			t.Run(fmt.Sprintf("%s v%d", tc.name, proto), func(t *testing.T) {
+				tc.run(t, c, p)
+			})
+			p.out.Close()
+		}
+	}
+}
+
+func TestMuxCalls(t *testing.T) {
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	services := &Services{}
+	services.Register("block", func(ctx context.Context, payload []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-release
+		return payload, nil
+	})
+	c, p := pipeMux(protoV2, services)
+	defer p.out.Close()
+	for id := uint64(1); id <= 2; id++ {
+		p.reply(frame{typ: frameCall, id: id, data: []byte("block\nx")})
+	}
+	<-started
+	// Процесс выполняет одну задачу, поэтому второй вызов ждет первый.
+	select {
+	case <-started:
+		t.Fatal("calls exceed worker concurrency")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if f := <-p.frames; f.typ != frameReply || string(f.data) != "x" {
+			t.Fatalf("unexpected reply %d %q", f.typ, f.data)
+		}
+	}
+	c.close(io.EOF)
+}
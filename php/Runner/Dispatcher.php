@@ -3,11 +3,26 @@
 namespace Runner;
 
 /**
- * Прослойка между приложением PHP и corerunner. Открывает stdin, слушает
- * proto-сообщения от coreruner, обрабатывает их и отдает ответ в stdout.
+ * Прослойка между приложением PHP и corerunner. Открывает stdin (или сокет либо
+ * файловые дескрипторы из переменной окружения CORERUNNER_ADDR), слушает
+ * proto-сообщения от coreruner, обрабатывает их и отдает ответ в stdout (или
+ * тот же сокет).
  */
 final class Dispatcher
 {
+    // Заголовок кадра протокола версии 2, см. frame.go.
+    private const FRAME_MAGIC = 0x4352;
+    private const FRAME_HEADER_SIZE = 20;
+    private const FRAME_REQUEST = 1;
+    private const FRAME_RESPONSE = 2;
+    private const FRAME_STOP = 3;
+    private const FRAME_CALL = 4;
+    private const FRAME_REPLY = 5;
+    private const FRAME_CHUNK = 6;
+    private const FRAME_PING = 7;
+    private const FRAME_PONG = 8;
+    private const FRAME_FLAG_ERROR = 1;
+
     /** @var resource */
     private mixed $in;
 
@@ -17,17 +32,84 @@ final class Dispatcher
     /** @var resource */
     private mixed $err;
 
+    /** Версия протокола, выбранная corerunner. */
+    private int $version = 1;
+
+    /** Идентификатор обрабатываемого сообщения. */
+    private int $requestId = 0;
+
+    /** Идентификатор последнего вызова сервиса Go. */
+    private int $callId = 0;
+
+    /** Идет обработка сообщения, см. handle(). */
+    private bool $busy = false;
+
+    /** Сигнал, прервавший обработку текущего сообщения, или 0. */
+    private int $interrupted = 0;
+
+    /**
+     * Кадры, пришедшие во время ожидания ответа на вызов сервиса, см. call().
+     *
+     * @var array[]
+     */
+    private array $pending = [];
+
+    /** Проверка работоспособности приложения, см. onPing(). */
+    private ?\Closure $ping = null;
+
+    /** Название и сборка приложения и выполняемые задачи, см. describe(). */
+    private string $app = '';
+    private string $build = '';
+    /** @var string[] */
+    private array $jobs = [];
+
     public function __construct()
     {
-        $this->in = fopen('php://stdin', 'r');
-        $this->out = fopen('php://stdout', 'w');
         $this->err = fopen('php://stderr', 'w');
+
+        // Если corerunner передал адрес сокета (или процесс запущен
+        // отдельно и подключается к corerunner сам), общаемся через него,
+        // иначе через stdin и stdout.
+        $addr = getenv('CORERUNNER_ADDR');
+
+        if ($addr === false || $addr === '') {
+            $this->in = fopen('php://stdin', 'r');
+            $this->out = fopen('php://stdout', 'w');
+
+            return;
+        }
+
+        // Дополнительные файловые дескрипторы: fd://<чтение>,<запись>.
+        if (str_starts_with($addr, 'fd://')) {
+            [$in, $out] = explode(',', substr($addr, 5), 2);
+            $this->in = fopen('php://fd/'.(int) $in, 'r');
+            $this->out = fopen('php://fd/'.(int) $out, 'w');
+
+            return;
+        }
+
+        $errno = 0;
+        $error = '';
+        $socket = stream_socket_client($addr, $errno, $error);
+
+        if ($socket === false) {
+            throw new \RuntimeException(
+                sprintf('Could not connect to %s: %d: %s', $addr, $errno, $error)
+            );
+        }
+
+        $this->in = $socket;
+        $this->out = $socket;
     }
 
     public function __destruct()
     {
         fclose($this->in);
-        fclose($this->out);
+
+        if ($this->out !== $this->in) {
+            fclose($this->out);
+        }
+
         fclose($this->err);
     }
 
@@ -37,20 +119,205 @@ final class Dispatcher
      */
     public function run(\Closure $handler): void
     {
-        // Сообщаем серверу, что готовы принимать запросы.
-        fwrite($this->out, "ok\n");
+        // Сообщаем серверу, что готовы принимать запросы, и перечисляем
+        // поддерживаемые версии протокола и кадры, а также приложение, по
+        // которым сервер проверяет, подходит ли ему процесс. В ответ сервер
+        // сообщает выбранную версию.
+        fwrite($this->out, 'hello '.json_encode([
+            'proto' => [1, 2],
+            'runtime' => 'php '.PHP_VERSION,
+            'frames' => [
+                self::FRAME_REQUEST,
+                self::FRAME_RESPONSE,
+                self::FRAME_STOP,
+                self::FRAME_CALL,
+                self::FRAME_REPLY,
+                self::FRAME_CHUNK,
+                self::FRAME_PING,
+                self::FRAME_PONG,
+            ],
+            'app' => $this->app,
+            'build' => $this->build,
+            'jobs' => $this->jobs,
+            'pid' => getmypid(),
+            // Секрет для подключения внешнего процесса, см. Pool.WorkerToken.
+            'token' => (string) getenv('CORERUNNER_TOKEN'),
+        ])."\n");
+        $reply = fgets($this->in);
+
+        if ($reply !== false && preg_match('/\bproto=(\d+)/', $reply, $m)) {
+            $this->version = (int) $m[1];
+        }
+
+        // При таймауте задачи corerunner отправляет сигнал (Worker.TimeoutSignal)
+        // и дает время ее завершить: исключение прерывает обработку запроса,
+        // позволяя откатить транзакции и вывести трассировку в лог. Вне
+        // обработки сообщения сигнал, как обычно, завершает процесс.
+        if (function_exists('pcntl_async_signals')) {
+            pcntl_async_signals(true);
+
+            foreach ([SIGTERM, SIGALRM] as $signal) {
+                pcntl_signal($signal, function (int $signal): void {
+                    if (!$this->busy) {
+                        exit(128 + $signal);
+                    }
+
+                    $this->interrupted = $signal;
+
+                    throw new \RuntimeException(sprintf('Job interrupted by signal %d', $signal));
+                });
+            }
+        }
 
         try {
-            foreach ($this->messages() as $msg) {
-                $this->send($handler($msg));
+            foreach ($this->messages() as [$id, $msg]) {
+                $this->requestId = $id;
+                $this->handle($handler, $id, $msg);
             }
         } catch (\Throwable $e) {
             $this->error($e->getMessage(), $e->getTraceAsString());
         }
     }
 
+    /**
+     * Обрабатывает сообщение и отправляет ответ. Если обработку прервал
+     * сигнал, то в версии 2 протокола отправляется ответ с ошибкой, даже если
+     * приложение перехватило исключение, а в версии 1, где ответить ошибкой
+     * нельзя, процесс завершается.
+     */
+    private function handle(\Closure $handler, int $id, string $msg): void
+    {
+        $this->interrupted = 0;
+        $this->busy = true;
+
+        try {
+            $res = $handler($msg);
+        } catch (\Throwable $e) {
+            if ($this->interrupted === 0 || $this->version !== 2) {
+                throw $e;
+            }
+
+            $this->error($e->getMessage(), $e->getTraceAsString());
+        } finally {
+            $this->busy = false;
+        }
+
+        if ($this->interrupted !== 0) {
+            $error = sprintf('Job interrupted by signal %d', $this->interrupted);
+
+            if ($this->version !== 2) {
+                throw new \RuntimeException($error);
+            }
+
+            $this->write(self::FRAME_RESPONSE, $id, $error, self::FRAME_FLAG_ERROR);
+            fflush($this->out);
+
+            return;
+        }
+
+        $this->send($id, $res);
+    }
+
+    /**
+     * Сообщает corerunner название и сборку приложения (например, хэш
+     * коммита) и названия выполняемых задач. corerunner не допускает к работе
+     * процессы, которые не совпадают с флагами -app, -build и -require-jobs.
+     * Вызывается до run().
+     *
+     * @param string[] $jobs
+     */
+    public function describe(string $app, string $build = '', array $jobs = []): void
+    {
+        $this->app = $app;
+        $this->build = $build;
+        $this->jobs = array_values($jobs);
+    }
+
+    /**
+     * Задает проверку, которая выполняется, когда corerunner проверяет
+     * простаивающий процесс (только в версии 2 протокола). Если $check
+     * выбрасывает исключение, например, при потере соединения с базой данных,
+     * corerunner перезапускает процесс до того, как он получит запрос.
+     */
+    public function onPing(\Closure $check): void
+    {
+        $this->ping = $check;
+    }
+
+    /**
+     * Вызывает сервис Go, зарегистрированный в Pool.Services, и возвращает
+     * результат. Может вызываться из $handler во время обработки сообщения.
+     * Требует версию 2 протокола.
+     */
+    public function call(string $service, string $payload = ''): string
+    {
+        if ($this->version !== 2) {
+            throw new \RuntimeException('Calls require protocol version 2');
+        }
+
+        $id = ++$this->callId;
+        $this->write(self::FRAME_CALL, $id, $service."\n".$payload);
+
+        fflush($this->out);
+
+        while (($frame = $this->readFrame()) !== false) {
+            if ($frame['type'] === self::FRAME_REPLY && $frame['id'] === $id) {
+                if ($frame['flags'] & self::FRAME_FLAG_ERROR) {
+                    throw new \RuntimeException("Service $service error: {$frame['data']}");
+                }
+
+                return $frame['data'];
+            }
+
+            // На проверку отвечаем сразу, а запросы и остановку
+            // обрабатываем после текущего сообщения.
+            if ($frame['type'] === self::FRAME_PING) {
+                $this->pong($frame['id']);
+            } elseif ($frame['type'] !== self::FRAME_REPLY) {
+                $this->pending[] = $frame;
+            }
+        }
+
+        throw new \RuntimeException('Could not read reply from corerunner');
+    }
+
+    /**
+     * Отправляет часть ответа на обрабатываемое сообщение, не дожидаясь
+     * завершения $handler. Результат $handler отправляется последним. Для
+     * HTTP первая часть -- сериализованный HTTPResponse со статусом,
+     * заголовками и, возможно, началом тела, следующие -- продолжение тела.
+     * Требует версию 2 протокола.
+     */
+    public function chunk(string $data): void
+    {
+        if ($this->version !== 2) {
+            throw new \RuntimeException('Streaming requires protocol version 2');
+        }
+
+        $this->write(self::FRAME_CHUNK, $this->requestId, $data);
+        fflush($this->out);
+    }
+
     private function messages(): iterable
     {
+        if ($this->version === 2) {
+            while (($frame = array_shift($this->pending) ?? $this->readFrame()) !== false) {
+                if ($frame['type'] === self::FRAME_STOP) {
+                    break;
+                }
+
+                if ($frame['type'] === self::FRAME_REQUEST) {
+                    yield [$frame['id'], $frame['data']];
+                }
+
+                if ($frame['type'] === self::FRAME_PING) {
+                    $this->pong($frame['id']);
+                }
+            }
+
+            return;
+        }
+
         while (($line = fgets($this->in)) !== false) {
             $line = rtrim($line, "\n");
 
@@ -58,23 +325,67 @@ final class Dispatcher
                 break;
             }
 
-            $len = (int) $line;
-            $msg = '';
+            $msg = $this->read((int) $line);
 
-            while (($data = fread($this->in, min($len, 2048))) !== false) {
-                $msg .= $data;
-                $len -= strlen($data);
+            if ($msg === false) {
+                break;
+            }
 
-                if ($len <= 0) {
-                    yield $msg;
-                    break;
-                }
+            yield [0, $msg];
+        }
+    }
+
+    /**
+     * Читает кадр протокола версии 2. Данные кадра -- в ключе data.
+     */
+    private function readFrame(): array|false
+    {
+        $header = $this->read(self::FRAME_HEADER_SIZE);
+
+        if ($header === false) {
+            return false;
+        }
+
+        $frame = unpack('nmagic/Cversion/Ctype/Nflags/Jid/Nlength', $header);
+
+        if ($frame['magic'] !== self::FRAME_MAGIC) {
+            throw new \RuntimeException('Invalid frame magic');
+        }
+
+        $frame['data'] = $this->read($frame['length']);
+
+        return $frame['data'] === false ? false : $frame;
+    }
+
+    /**
+     * Читает ровно $len байт частями по 2048 байт.
+     */
+    private function read(int $len): string|false
+    {
+        $msg = '';
+
+        while ($len > 0) {
+            $data = fread($this->in, min($len, 2048));
+
+            if ($data === false || $data === '') {
+                return false;
             }
+
+            $msg .= $data;
+            $len -= strlen($data);
         }
+
+        return $msg;
     }
 
-    private function send(string $data): void
+    private function send(int $id, string $data): void
     {
+        if ($this->version === 2) {
+            $this->write(self::FRAME_RESPONSE, $id, $data);
+
+            return;
+        }
+
         fwrite($this->out, strlen($data)."\n");
 
         foreach (str_split($data, 2048) as $spl) {
@@ -82,6 +393,44 @@ final class Dispatcher
         }
     }
 
+    /**
+     * Отвечает на проверку работоспособности процесса.
+     */
+    private function pong(int $id): void
+    {
+        try {
+            if ($this->ping !== null) {
+                ($this->ping)();
+            }
+
+            $this->write(self::FRAME_PONG, $id, '');
+        } catch (\Throwable $e) {
+            $this->write(self::FRAME_PONG, $id, $e->getMessage(), self::FRAME_FLAG_ERROR);
+        }
+
+        fflush($this->out);
+    }
+
+    /**
+     * Отправляет кадр протокола версии 2.
+     */
+    private function write(int $type, int $id, string $data, int $flags = 0): void
+    {
+        fwrite($this->out, pack(
+            'nCCNJN',
+            self::FRAME_MAGIC,
+            2,
+            $type,
+            $flags,
+            $id,
+            strlen($data),
+        ));
+
+        foreach (str_split($data, 2048) as $spl) {
+            fwrite($this->out, $spl);
+        }
+    }
+
     private function error(string $error, string $context = null): void
     {
         fwrite($this->err, "\033[1;31mError from PHP: $error\033[0m\n");
@@ -10,6 +10,9 @@ final class HTTPRequest
      * @param array<string, string> $headers
      * @param array<string, File> $files
      * @param array<string, string> $form
+     * @param ?string $bodyPath путь к временному файлу с телом запроса, если
+     * тело слишком большое для передачи в сообщении. $body в этом случае
+     * пуст.
      */
     public function __construct(
         public readonly string $method,
@@ -18,6 +21,7 @@ final class HTTPRequest
         public readonly array $headers,
         public readonly array $files,
         public readonly array $form,
+        public readonly ?string $bodyPath = null,
     ) {
     }
 }
@@ -87,13 +87,22 @@ final class Serializer
             );
         }
 
+        $bodyPath = $this->parseString($stream);
+
+        if ($bodyPath === false) {
+            throw new \RuntimeException(
+                'Не получилось десериализовать поле bodyPath.'
+            );
+        }
+
         return new Messages\HTTPRequest(
             $method,
             $url,
             $body,
             $headers,
             $files,
-            $form
+            $form,
+            $bodyPath === '' ? null : $bodyPath,
         );
     }
 
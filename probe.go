@@ -0,0 +1,84 @@
+package corerunner
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	// Время ожидания ответа на ping по умолчанию.
+	DefaultPingTimeout = time.Second
+)
+
+// probeIdle периодически просит воркеры, простаивающие дольше PingInterval,
+// проверить свои процессы. Работает до закрытия done.
+func (p *Pool) probeIdle(done chan struct{}) {
+	interval := p.PingInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		for _, wrk := range append(p.workers(), p.externalWorkers()...) {
+			if wrk.idle() >= interval {
+				wrk.requestProbe()
+			}
+		}
+	}
+}
+
+// requestProbe просит воркер проверить процесс, если он простаивает. Проверка
+// выполняется циклом обработки задач, поэтому не пересекается с задачами.
+func (wrk *Worker) requestProbe() {
+	select {
+	case wrk.probeCh <- struct{}{}:
+	default:
+	}
+}
+
+// probe отправляет процессу ping. Если ответ содержит ошибку, процесс штатно
+// перезапускается, а если не пришел за PingTimeout, то процесс считается
+// зависшим и убивается. Процессы, не поддерживающие ping, не проверяются.
+// Вызывается циклом обработки задач между задачами.
+func (wrk *Worker) probe() {
+	wrk.life.Lock()
+	proc, mux, pings := wrk.proc, wrk.mux, wrk.pings
+	wrk.life.Unlock()
+	if mux == nil || !pings {
+		return
+	}
+	timeout := wrk.PingTimeout
+	if timeout <= 0 {
+		timeout = DefaultPingTimeout
+	}
+	err := mux.ping(timeout)
+	switch {
+	case err == nil:
+	case errors.Is(err, errNoPong):
+		log.Printf("PID %d: killing worker (%s)", proc.pid, err)
+		wrk.restartFailed(proc)
+	default:
+		log.Printf("PID %d: ping failed: %s", proc.pid, err)
+		wrk.recycle("ping failed")
+	}
+}
+
+// Ready сообщает, что пул запущен, не останавливается и хотя бы один его
+// воркер готов выполнять задачи. Воркеры, не ответившие на ping,
+// перезапускаются и до готовности нового процесса не учитываются.
+// Предназначен для readiness-проверок.
+func (p *Pool) Ready() bool {
+	if p.done == nil || p.stopping() {
+		return false
+	}
+	for _, wrk := range append(p.workers(), p.externalWorkers()...) {
+		if s := wrk.State(); s == WorkerIdle || s == WorkerBusy {
+			return true
+		}
+	}
+	return false
+}
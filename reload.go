@@ -0,0 +1,133 @@
+package corerunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// Количество неудачных запусков новых воркеров подряд по умолчанию,
+	// после которого Reload прерывается.
+	DefaultReloadMaxFailures = 3
+	// Пауза перед повторной попыткой запуска воркера при Reload.
+	reloadRetryDelay = time.Second
+)
+
+var (
+	ErrReloadAborted = errors.New("reload aborted")
+)
+
+// Reload поочередно заменяет все воркеры пула новыми процессами, не
+// останавливая обработку очереди. Старый воркер останавливается только после
+// того, как заменяющий его процесс успешно запустился. Одновременно
+// заменяется до ReloadBatch воркеров. Если новые процессы не запускаются
+// ReloadMaxFailures раз подряд, то Reload прерывается с ошибкой
+// ErrReloadAborted, а оставшиеся старые воркеры продолжают работу.
+func (p *Pool) Reload(ctx context.Context) error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	return p.reload(ctx)
+}
+
+// ReloadBuild работает как Reload, но с ее начала процессы пула должны
+// сообщать в приветствии сборку build вместо Pool.Build. Так при выкладке
+// новой версии приложения к работе допускаются новые процессы, а процессы
+// прежней сборки, например, внешние, отклоняются. Сборка остается новой, даже
+// если Reload прерван, поскольку новые процессы запускают уже новый код.
+func (p *Pool) ReloadBuild(ctx context.Context, build string) error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	p.mu.Lock()
+	prev := p.Build
+	p.Build = build
+	p.mu.Unlock()
+	if prev != build {
+		log.Printf("pool: expecting build %q instead of %q", build, prev)
+	}
+	return p.reload(ctx)
+}
+
+// expectedBuild возвращает сборку, которую должны сообщать процессы пула.
+func (p *Pool) expectedBuild() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Build
+}
+
+// reload работает как Reload, но вызывается с захваченной блокировкой
+// reloadMu.
+func (p *Pool) reload(ctx context.Context) error {
+	batch := p.ReloadBatch
+	if batch <= 0 {
+		batch = 1
+	}
+	maxFailures := p.ReloadMaxFailures
+	if maxFailures <= 0 {
+		maxFailures = DefaultReloadMaxFailures
+	}
+	start := time.Now()
+	old := p.workers()
+	log.Printf("pool: reloading %d workers", len(old))
+	failures := 0
+	for len(old) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := min(batch, len(old))
+		started, err := p.spawnBatch(n)
+		if err != nil {
+			failures++
+			log.Printf(
+				"pool: reload: could not start worker (%d/%d): %s",
+				failures, maxFailures, err,
+			)
+			if failures >= maxFailures {
+				return fmt.Errorf("%w: %s", ErrReloadAborted, err)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(reloadRetryDelay):
+			}
+		} else {
+			failures = 0
+		}
+		// Останавливаем столько старых воркеров, сколько новых
+		// успешно запустилось.
+		for _, wrk := range old[:started] {
+			p.remove(wrk)
+		}
+		old = old[started:]
+	}
+	log.Printf("pool: reloaded in %s", time.Since(start))
+	return nil
+}
+
+// spawnBatch параллельно запускает n новых воркеров. Возвращает количество
+// запущенных воркеров и последнюю ошибку запуска.
+func (p *Pool) spawnBatch(n int) (int, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	started := 0
+	var werr error
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			err := p.spawn()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				werr = err
+				return
+			}
+			started++
+		}()
+	}
+	wg.Wait()
+	return started, werr
+}
@@ -0,0 +1,38 @@
+package corerunner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReloadBuild(t *testing.T) {
+	p := &Pool{Build: "old"}
+	if err := p.Start(nil, 0, nil); err != nil {
+		t.Fatalf("could not start pool: %s", err)
+	}
+	defer p.Stop()
+	// connect подключает внешний воркер сборки build и сообщает, принял
+	// ли его пул.
+	connect := func(build string) bool {
+		srv, cli := net.Pipe()
+		go func() {
+			fmt.Fprintf(cli, "hello {\"proto\":[1],\"build\":%q}\n", build)
+			io.Copy(io.Discard, cli)
+		}()
+		n := len(p.externalWorkers())
+		p.attach(srv)
+		return len(p.externalWorkers()) > n
+	}
+	if !connect("old") || connect("new") {
+		t.Fatal("only workers of the initial build must be accepted")
+	}
+	if err := p.ReloadBuild(context.Background(), "new"); err != nil {
+		t.Fatalf("could not reload: %s", err)
+	}
+	if connect("old") || !connect("new") {
+		t.Fatal("only workers of the new build must be accepted after reload")
+	}
+}
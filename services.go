@@ -0,0 +1,51 @@
+package corerunner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Service обрабатывает вызов процесса к Go (кадр вызова протокола версии 2).
+// ctx отменяется, если процесс завершается до окончания вызова.
+type Service func(ctx context.Context, payload []byte) ([]byte, error)
+
+// Services -- реестр функций Go, которые процессы могут вызывать во время
+// выполнения задачи через тот же канал, по которому получают задачи. Нулевое
+// значение готово к использованию.
+//
+// Кадр вызова (frameCall) содержит идентификатор вызова, выбранный процессом,
+// и данные вида:
+// [название сервиса]\n[payload]
+//
+// Go отвечает кадром frameReply с тем же идентификатором, содержащим результат
+// или, с флагом frameFlagError, текст ошибки.
+type Services struct {
+	mu       sync.RWMutex
+	services map[string]Service
+}
+
+// Register регистрирует сервис под именем name, заменяя ранее
+// зарегистрированный.
+func (s *Services) Register(name string, fn Service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.services == nil {
+		s.services = make(map[string]Service)
+	}
+	s.services[name] = fn
+}
+
+// Call вызывает сервис name.
+func (s *Services) Call(ctx context.Context, name string, payload []byte) ([]byte, error) {
+	var fn Service
+	if s != nil {
+		s.mu.RLock()
+		fn = s.services[name]
+		s.mu.RUnlock()
+	}
+	if fn == nil {
+		return nil, fmt.Errorf("unknown service %q", name)
+	}
+	return fn(ctx, payload)
+}
@@ -0,0 +1,146 @@
+package corerunner
+
+import (
+	"time"
+)
+
+// Состояние воркера.
+type WorkerState int32
+
+const (
+	// Процесс не запущен: еще не запускался, остановлен или упал и ждет
+	// повторного запуска.
+	WorkerStopped WorkerState = iota
+	// Процесс запускается и еще не подтвердил готовность к работе.
+	WorkerStarting
+	// Процесс ждет задачу.
+	WorkerIdle
+	// Процесс выполняет задачу.
+	WorkerBusy
+	// Процесс останавливается.
+	WorkerStopping
+)
+
+func (s WorkerState) String() string {
+	switch s {
+	case WorkerStopped:
+		return "stopped"
+	case WorkerStarting:
+		return "starting"
+	case WorkerIdle:
+		return "idle"
+	case WorkerBusy:
+		return "busy"
+	case WorkerStopping:
+		return "stopping"
+	}
+	return "unknown"
+}
+
+// Снимок состояния воркера.
+type WorkerStats struct {
+	PID   int
+	State WorkerState
+	// Количество выполненных задач, задач, завершившихся ошибкой, и задач,
+	// превысивших таймаут, за все время работы воркера.
+	Jobs     uint64
+	Errors   uint64
+	Timeouts uint64
+	// Количество перезапусков процесса по любой причине.
+	Restarts uint64
+	// Время работы текущего процесса.
+	Uptime time.Duration
+	// Время выполнения текущей задачи или 0, если воркер не занят.
+	JobDuration time.Duration
+	// Воркер обслуживает внешний процесс (см. Pool.Serve). PID такого
+	// процесса известен, только если он сообщил его сам.
+	External bool
+	// Среда выполнения, приложение и сборка из приветствия процесса (см.
+	// handshake.go) или пустые строки, если процесс их не сообщил.
+	Runtime string
+	App     string
+	Build   string
+}
+
+// Снимок состояния пула.
+type PoolStats struct {
+	Workers []WorkerStats
+	// Количество задач, ожидающих в очереди, и размер очереди.
+	QueueLength   int
+	QueueCapacity int
+	// Количество задач, взятых воркерами из очереди, а также суммарное и
+	// максимальное время их ожидания в очереди за все время работы пула.
+	// Среднее время ожидания -- QueueWaitTotal / QueueWaitCount.
+	QueueWaitCount uint64
+	QueueWaitTotal time.Duration
+	QueueWaitMax   time.Duration
+	// См. Pool.Degraded.
+	Degraded bool
+	// См. Pool.Ready.
+	Ready bool
+	// Состояние дорожек очереди, если они заданы (см. Lane).
+	Lanes []LaneStats
+}
+
+// Stats возвращает снимок состояния пула и всех его воркеров. Предназначен для
+// административных страниц и экспорта метрик.
+func (p *Pool) Stats() PoolStats {
+	wrks := append(p.workers(), p.externalWorkers()...)
+	st := PoolStats{
+		Workers:        make([]WorkerStats, 0, len(wrks)),
+		QueueLength:    p.queueLength(),
+		QueueCapacity:  p.queueCapacity(),
+		QueueWaitCount: p.waitCount.Load(),
+		QueueWaitTotal: time.Duration(p.waitTotal.Load()),
+		QueueWaitMax:   time.Duration(p.waitPeak.Load()),
+		Degraded:       p.Degraded(),
+		Ready:          p.Ready(),
+	}
+	if p.sched != nil {
+		st.Lanes, st.QueueLength, st.QueueCapacity = p.sched.stats()
+	}
+	for _, wrk := range wrks {
+		st.Workers = append(st.Workers, wrk.Stats())
+	}
+	return st
+}
+
+// Stats возвращает снимок состояния воркера.
+func (wrk *Worker) Stats() WorkerStats {
+	st := WorkerStats{
+		PID:      wrk.Pid(),
+		State:    wrk.State(),
+		Jobs:     wrk.served.Load(),
+		Errors:   wrk.jobErrors.Load(),
+		Timeouts: wrk.timeouts.Load(),
+		Restarts: wrk.restarts.Load(),
+		Uptime:   wrk.uptime(),
+		External: wrk.external,
+	}
+	if st.State == WorkerBusy {
+		st.JobDuration = time.Since(time.Unix(0, wrk.jobStart.Load()))
+	}
+	if h := wrk.hello.Load(); h != nil {
+		st.Runtime, st.App, st.Build = h.runtime, h.app, h.build
+	}
+	return st
+}
+
+// State возвращает текущее состояние воркера.
+func (wrk *Worker) State() WorkerState {
+	return WorkerState(wrk.state.Load())
+}
+
+func (wrk *Worker) setState(s WorkerState) {
+	wrk.state.Store(int32(s))
+}
+
+// uptime возвращает время работы текущего процесса или 0, если процесс не
+// запущен.
+func (wrk *Worker) uptime() time.Duration {
+	started := wrk.started.Load()
+	if started == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, started))
+}
@@ -0,0 +1,218 @@
+package corerunner
+
+import (
+	"io"
+	"log"
+	"os/exec"
+	"time"
+)
+
+const (
+	// Количество неудачных запусков и неожиданных завершений воркеров по
+	// умолчанию, после которого пул считается деградировавшим.
+	DefaultCrashLoopThreshold = 5
+	// Период по умолчанию, за который учитываются неудачные запуски и
+	// неожиданные завершения воркеров.
+	DefaultCrashLoopWindow = time.Minute
+	// Минимальная и максимальная задержка перед повторным запуском упавшего
+	// процесса.
+	respawnBackoffMin = 100 * time.Millisecond
+	respawnBackoffMax = 30 * time.Second
+	// Время без падений, после которого задержка перед повторным запуском
+	// сбрасывается.
+	crashReset = time.Minute
+)
+
+// Результат завершения процесса. done закрывается после завершения, после
+// чего можно читать err.
+type procExit struct {
+	done chan struct{}
+	err  error
+}
+
+// Процесс воркера. Для внешних воркеров cmd == nil, а завершением процесса
+// считается закрытие соединения.
+type process struct {
+	cmd  *exec.Cmd
+	conn io.ReadWriteCloser
+	pid  int
+}
+
+// kill немедленно завершает процесс вместе с запущенными им процессами или
+// разрывает соединение с внешним.
+func (p *process) kill() error {
+	if p.cmd == nil {
+		return p.conn.Close()
+	}
+	return killProcess(p.cmd.Process)
+}
+
+// wait дожидается завершения процесса или закрытия соединения с внешним.
+func (p *process) wait() error {
+	if p.cmd == nil {
+		<-p.conn.(*extConn).closed
+		return nil
+	}
+	err := p.cmd.Wait()
+	// Соединения, созданные транспортом, не закрываются вместе с
+	// процессом.
+	p.conn.Close()
+	return err
+}
+
+// supervise дожидается завершения процесса proc и сообщает о нем циклу
+// обработки задач, который сразу запускает новый процесс, если proc
+// завершился сам по себе. Падения во время выполнения задачи обрабатываются
+// раньше в timedSend, тогда сообщение просто игнорируется.
+func (wrk *Worker) supervise(proc *process, exit *procExit) {
+	exit.err = proc.wait()
+	close(exit.done)
+	select {
+	case wrk.crashed <- proc:
+	case <-wrk.done:
+	}
+}
+
+// handleCrash запускает новый процесс взамен неожиданно завершившегося proc.
+// Если proc уже остановлен штатно или перезапущен, ничего не делает. Внешние
+// и останавливающиеся воркеры не перезапускаются.
+func (wrk *Worker) handleCrash(proc *process) {
+	wrk.life.Lock()
+	defer wrk.life.Unlock()
+	if wrk.proc != proc {
+		return
+	}
+	if wrk.external {
+		log.Printf("PID %d: external worker disconnected", proc.pid)
+		wrk.mu.Lock()
+		wrk.reset()
+		wrk.mu.Unlock()
+		return
+	}
+	log.Printf(
+		"PID %d: worker exited unexpectedly: %v",
+		proc.pid, wrk.exit.err,
+	)
+	if wrk.retiring() {
+		// Воркер останавливается, новый процесс не нужен.
+		wrk.mu.Lock()
+		wrk.reset()
+		wrk.mu.Unlock()
+		return
+	}
+	wrk.failed()
+	wrk.mu.Lock()
+	wrk.reset()
+	wrk.mu.Unlock()
+	wrk.respawn()
+}
+
+// respawn запускает новый процесс взамен упавшего, повторяя попытки с
+// экспоненциально растущей задержкой, пока процесс не запустится или воркер не
+// будет остановлен. Вызывается с захваченной блокировкой life.
+func (wrk *Worker) respawn() {
+	if wrk.external {
+		return
+	}
+	for {
+		if delay := wrk.backoff(); delay > 0 {
+			log.Printf("respawning worker in %s", delay)
+			select {
+			case <-time.After(delay):
+			case <-wrk.quit:
+				return
+			}
+		}
+		wrk.mu.Lock()
+		err := wrk.start(wrk.argv, wrk.env)
+		wrk.mu.Unlock()
+		if err == nil {
+			log.Printf("PID %d: worker respawned", wrk.Pid())
+			return
+		}
+		log.Printf("could not respawn worker: %s", err)
+		wrk.failed()
+	}
+}
+
+// failed учитывает падение процесса или неудачный запуск.
+func (wrk *Worker) failed() {
+	if time.Since(wrk.lastCrash) > crashReset {
+		wrk.crashes = 0
+	}
+	wrk.crashes++
+	wrk.lastCrash = time.Now()
+	if wrk.pool != nil {
+		wrk.pool.recordFailure()
+	}
+}
+
+// backoff возвращает задержку перед очередной попыткой запуска процесса.
+// Первое падение перезапускается сразу, далее задержка удваивается. Если пул
+// деградировал, используется максимальная задержка.
+func (wrk *Worker) backoff() time.Duration {
+	if wrk.crashes <= 1 {
+		return 0
+	}
+	if wrk.pool != nil && wrk.pool.Degraded() {
+		return respawnBackoffMax
+	}
+	delay := respawnBackoffMin
+	for i := 2; i < wrk.crashes && delay < respawnBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > respawnBackoffMax {
+		delay = respawnBackoffMax
+	}
+	return delay
+}
+
+// recordFailure учитывает неудачный запуск или неожиданное завершение воркера
+// пула.
+func (p *Pool) recordFailure() {
+	p.failMu.Lock()
+	defer p.failMu.Unlock()
+	p.failures = append(p.failures, time.Now())
+	p.checkDegraded()
+}
+
+// Degraded сообщает, что воркеры пула не запускаются или падают: за последние
+// CrashLoopWindow произошло не меньше CrashLoopThreshold неудачных запусков
+// или неожиданных завершений процессов. Деградировавший пул перезапускает
+// упавшие воркеры с максимальной задержкой. Предназначен для health-check'ов.
+func (p *Pool) Degraded() bool {
+	p.failMu.Lock()
+	defer p.failMu.Unlock()
+	return p.checkDegraded()
+}
+
+// checkDegraded удаляет устаревшие падения, обновляет и возвращает состояние
+// пула. Вызывается с захваченной блокировкой failMu.
+func (p *Pool) checkDegraded() bool {
+	threshold := p.CrashLoopThreshold
+	if threshold <= 0 {
+		threshold = DefaultCrashLoopThreshold
+	}
+	window := p.CrashLoopWindow
+	if window <= 0 {
+		window = DefaultCrashLoopWindow
+	}
+	i := 0
+	for i < len(p.failures) && time.Since(p.failures[i]) > window {
+		i++
+	}
+	p.failures = p.failures[i:]
+	degraded := len(p.failures) >= threshold
+	if degraded != p.degraded {
+		if degraded {
+			log.Printf(
+				"pool: degraded, %d worker failures in %s",
+				len(p.failures), window,
+			)
+		} else {
+			log.Println("pool: recovered")
+		}
+		p.degraded = degraded
+	}
+	return degraded
+}
@@ -0,0 +1,275 @@
+package corerunner
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Переменная окружения, в которой процесс получает адрес сокета для
+	// подключения к Go, например, unix:///tmp/corerunner.sock или
+	// tcp://127.0.0.1:7000, или номера файловых дескрипторов для чтения и
+	// записи, например, fd://3,4.
+	TransportAddrEnv = "CORERUNNER_ADDR"
+	// Переменная окружения с секретом, который процесс сообщает в
+	// приветствии. Внешние процессы получают его от администратора (см.
+	// Pool.WorkerToken), а запущенные через UnixTransport и TCPTransport --
+	// от пула, новый при каждом запуске.
+	WorkerTokenEnv = "CORERUNNER_TOKEN"
+	// Время, за которое запущенный процесс должен подключиться к сокету.
+	socketConnectTimeout = 10 * time.Second
+)
+
+// Transport устанавливает соединение между Go и запускаемым процессом воркера.
+// По умолчанию используется StdioTransport.
+type Transport interface {
+	// Connect запускает cmd и возвращает соединение с ним. Если процесс
+	// запущен, но соединение не установлено, возвращается ошибка, а
+	// процесс завершает вызывающий. Stdout и stderr процесса уже
+	// направлены в лог воркера, транспорт, которому stdout нужен для
+	// протокола, может переопределить cmd.Stdout.
+	Connect(cmd *exec.Cmd) (io.ReadWriteCloser, error)
+}
+
+// StdioTransport общается с процессом через его stdin и stdout.
+type StdioTransport struct{}
+
+func (StdioTransport) Connect(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	cmd.Stdout = nil
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return pipeConn{stdout, stdin}, nil
+}
+
+// Соединение через stdin и stdout процесса. Закрытие закрывает stdin, stdout
+// закрывается при завершении процесса.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// FDTransport общается с процессом через два дополнительных файловых
+// дескриптора (по умолчанию 3 для чтения процессом и 4 для записи),
+// передаваемых через cmd.ExtraFiles. Номера дескрипторов процесс получает в
+// переменной окружения TransportAddrEnv. Случайный вывод процесса в stdout,
+// например, echo или предупреждения PHP, не ломает протокол, а выводится в
+// лог построчно.
+type FDTransport struct{}
+
+func (FDTransport) Connect(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	// Go пишет в inW, процесс читает из inR, и наоборот.
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, inR, outW)
+	setEnv(cmd, fmt.Sprintf("fd://%d,%d", fd, fd+1))
+	err = cmd.Start()
+	// Копии дескрипторов процесса больше не нужны. Без закрытия outW
+	// чтение не получит EOF после завершения процесса.
+	inR.Close()
+	outW.Close()
+	if err != nil {
+		inW.Close()
+		outR.Close()
+		return nil, err
+	}
+	return &fdConn{Reader: outR, r: outR, w: inW}, nil
+}
+
+// Соединение через пару pipe. Закрытие закрывает оба конца.
+type fdConn struct {
+	io.Reader
+	r, w *os.File
+}
+
+func (c *fdConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *fdConn) Close() error {
+	err := c.w.Close()
+	if rerr := c.r.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// UnixTransport слушает Unix-сокет, адрес которого процесс получает в
+// переменной окружения TransportAddrEnv. Для каждого процесса создается
+// отдельный сокет в закрытой от остальных пользователей поддиректории Dir (по
+// умолчанию os.TempDir()), которая передается пользователю процесса (см.
+// Isolation.UID).
+type UnixTransport struct {
+	Dir string
+}
+
+func (t UnixTransport) Connect(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	dir := t.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	dir, err := os.MkdirTemp(dir, "corerunner-")
+	if err != nil {
+		return nil, err
+	}
+	// Сокет нужен только до подключения процесса.
+	defer os.RemoveAll(dir)
+	if err := chownProcess(dir, cmd); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "worker.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return connectSocket(cmd, l, "unix://"+path)
+}
+
+// TCPTransport слушает TCP-порт на адресе Host (по умолчанию 127.0.0.1),
+// который процесс получает в переменной окружения TransportAddrEnv. Для
+// каждого процесса выбирается отдельный свободный порт.
+type TCPTransport struct {
+	Host string
+}
+
+func (t TCPTransport) Connect(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	host := t.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	return connectSocket(cmd, l, "tcp://"+l.Addr().String())
+}
+
+// connectSocket запускает cmd, передавая ему адрес addr слушающего сокета l
+// и секрет, и дожидается подключения процесса.
+func connectSocket(cmd *exec.Cmd, l net.Listener, addr string) (io.ReadWriteCloser, error) {
+	defer l.Close()
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	setEnv(cmd, addr)
+	cmd.Env = append(cmd.Env, WorkerTokenEnv+"="+token)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	if dl, ok := l.(interface{ SetDeadline(time.Time) error }); ok {
+		dl.SetDeadline(time.Now().Add(socketConnectTimeout))
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("worker did not connect to %s: %w", addr, err)
+	}
+	return &socketConn{Conn: conn, token: token}, nil
+}
+
+// Соединение с процессом через сокет. Подключиться к сокету мог и другой
+// локальный процесс, поэтому процесс должен сообщить в приветствии секрет
+// token, полученный в переменной окружения WorkerTokenEnv.
+type socketConn struct {
+	net.Conn
+	token string
+}
+
+// newToken возвращает случайный секрет для процесса.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// setEnv передает процессу адрес транспорта в переменной окружения
+// TransportAddrEnv.
+func setEnv(cmd *exec.Cmd, addr string) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, TransportAddrEnv+"="+addr)
+}
+
+// ParseListenAddr разбирает адрес вида unix:///path/to.sock или
+// tcp://host:port и возвращает сеть и адрес для net.Listen.
+func ParseListenAddr(addr string) (network, address string, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "unix":
+		return "unix", u.Path, nil
+	case "tcp":
+		return "tcp", u.Host, nil
+	}
+	return "", "", fmt.Errorf("unsupported address %q", addr)
+}
+
+// Соединение внешнего воркера. Закрывается при ошибке чтения или записи,
+// чтобы отключение процесса обнаруживалось так же, как завершение
+// запущенного.
+type extConn struct {
+	net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newExtConn(conn net.Conn) *extConn {
+	return &extConn{Conn: conn, closed: make(chan struct{})}
+}
+
+func (c *extConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		c.Close()
+	}
+	return n, err
+}
+
+func (c *extConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		c.Close()
+	}
+	return n, err
+}
+
+func (c *extConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = c.Conn.Close()
+		close(c.closed)
+	})
+	return err
+}
@@ -2,15 +2,18 @@ package corerunner
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"os"
 	"os/exec"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -20,50 +23,274 @@ const (
 	// передачи большого количества данных, но есть возможость упереться в
 	// ограничения транспорта.
 	// https://unix.stackexchange.com/questions/11946/how-big-is-the-pipe-buffer
+	//
+	// Deprecated: Go читает и пишет сообщения целиком, значение используется
+	// только Dispatcher на стороне PHP.
 	PipeChunkSize = 2048
+	// Максимальный размер сообщения от процесса (в байтах) по умолчанию.
+	DefaultMaxMessageSize = 64 << 20
+	// Сообщения больше этого размера (в байтах) читаются в буфер, растущий
+	// по мере поступления данных.
+	readBodyChunk = 64 << 10
 )
 
 var (
-	ErrWorkerTimedOut = errors.New("worker timed out")
+	ErrWorkerTimedOut  = errors.New("worker timed out")
+	errNotRunning      = errors.New("Worker is not running")
+	errExternal        = errors.New("external worker can not be started")
+	errMessageTooLarge = errors.New("message too large")
+	// Очередь пула заполнена до MaxQueue.
+	ErrQueueFull = errors.New("queue is full")
+	// Задача ждала в очереди дольше MaxQueueWait.
+	ErrQueueTimeout = errors.New("queue wait timed out")
+	// Пул остановлен и не принимает задачи.
+	ErrPoolStopped = errors.New("pool is stopped")
+	// Процесс ответил на задачу ошибкой (только в версии 2 протокола).
+	// Процесс при этом исправен и не перезапускается.
+	ErrJobFailed = errors.New("job failed")
+)
+
+// Поведение воркера при отмене контекста задачи, которая уже выполняется.
+// Задача, отмененная до начала выполнения, не выполняется в любом случае.
+type CancelPolicy int
+
+const (
+	// Задача выполняется до конца, ее результат отбрасывается.
+	CancelWait CancelPolicy = iota
+	// Процесс убивается и перезапускается, задача прерывается.
+	CancelKill
 )
 
 type Pool struct {
-	pool  []*Worker
-	queue chan WorkerJob
-	mu    sync.Mutex
+	// Количество задач, после выполнения которых воркер перезапускается.
+	// Помогает бороться с утечками памяти в приложении. При 0 количество
+	// задач не ограничивается.
+	MaxJobs int
+	// Время работы процесса, после которого воркер перезапускается, даже
+	// если простаивает. Занятый процесс дорабатывает текущую задачу. При 0
+	// время работы не ограничивается.
+	MaxUptime time.Duration
+	// Поведение при отмене контекста выполняющейся задачи, переданного в
+	// SendContext. По умолчанию CancelWait.
+	CancelPolicy CancelPolicy
+	// Отсрочка перед убийством процесса, не выполнившего задачу за timeout
+	// (см. Worker.TimeoutGrace). При 0 процесс убивается сразу.
+	TimeoutGrace time.Duration
+	// Сигнал, который процесс получает при превышении timeout, если задана
+	// TimeoutGrace. По умолчанию SIGTERM.
+	TimeoutSignal os.Signal
+	// Максимальное количество задач, одновременно выполняемых одним
+	// воркером, если он поддерживает мультиплексирование (см. mux.go). По
+	// умолчанию 1.
+	Concurrency int
+	// Сервисы Go, которые процессы могут вызывать во время выполнения
+	// задачи. Доступны процессам, использующим версию 2 протокола.
+	Services *Services
+	// Транспорт для связи с запускаемыми процессами. По умолчанию
+	// StdioTransport.
+	Transport Transport
+	// Максимальный размер сообщения от процесса (в байтах). Процесс,
+	// заявивший более длинное сообщение, например, из-за случайного вывода
+	// в протокол, перезапускается. По умолчанию DefaultMaxMessageSize.
+	MaxMessageSize int
+	// Название пула, которым помечаются логи процессов.
+	Name string
+	// Секрет, который внешние воркеры (см. Serve) должны сообщить в
+	// приветствии. Если не задан, то принимаются только подключения через
+	// Unix-сокеты и loopback-адреса.
+	WorkerToken string
+	// Название и сборка приложения, которые должны сообщать процессы в
+	// приветствии hello (см. handshake.go). Процессы другого приложения или
+	// другой сборки, например, со старым кодом во время выкладки, не
+	// допускаются к работе. Пустое значение не проверяется. После запуска
+	// пула сборка меняется только через ReloadBuild.
+	App   string
+	Build string
+	// Задачи, которые должны выполнять процессы пула согласно приветствию
+	// hello. Процессы, не выполняющие хотя бы одну из них, не допускаются к
+	// работе.
+	RequiredJobs []string
+	// Получатель логов (stdout и stderr) запущенных процессов. По
+	// умолчанию TextLogSink, выводящий их в стандартный логгер.
+	LogSink LogSink
+	// Максимальная длина записи лога процесса (в байтах), более длинные
+	// обрезаются. По умолчанию DefaultLogMaxLine.
+	LogMaxLine int
+	// Пользователь, ограничения ресурсов и группа cgroup запускаемых
+	// процессов. Поддерживается только в Linux.
+	Isolation Isolation
+	// Максимальное количество задач в очереди. Если очередь заполнена, Send
+	// сразу возвращает ErrQueueFull. При 0 размер очереди равен 512 задачам
+	// на воркер, а Send при заполненной очереди блокируется.
+	MaxQueue int
+	// Дорожки очереди с приоритетами и ограничениями (см. Lane). Дорожка
+	// задачи выбирается через WithLane. При пустом списке все задачи
+	// попадают в одну общую очередь.
+	Lanes []Lane
+	// Максимальное время ожидания задачи в очереди. Если ни один воркер не
+	// взял задачу за это время, возвращается ErrQueueTimeout. При 0 время
+	// ожидания не ограничивается.
+	MaxQueueWait time.Duration
+	// Время, в течение которого задача с ключом привязки (см. WithAffinity)
+	// ждет занятый предпочтительный воркер, прежде чем попасть в общую
+	// очередь. По умолчанию DefaultAffinityWait.
+	AffinityWait time.Duration
+	// Мягкое ограничение резидентной памяти процесса (в байтах). При
+	// превышении воркер штатно перезапускается после выполнения текущей
+	// задачи. При 0 память не ограничивается.
+	MemorySoftLimit uint64
+	// Жесткое ограничение резидентной памяти процесса (в байтах). При
+	// превышении процесс убивается, не дожидаясь выполнения текущей задачи.
+	// При 0 память не ограничивается.
+	MemoryHardLimit uint64
+	// Период проверки памяти процессов. По умолчанию
+	// DefaultMemoryCheckInterval.
+	MemoryCheckInterval time.Duration
+	// Период проверки простаивающих воркеров кадрами ping (только для
+	// процессов, поддерживающих их, см. handshake.go). Воркер, не ответивший
+	// за PingTimeout или ответивший ошибкой, перезапускается до того, как
+	// получит задачу. При 0 воркеры не проверяются.
+	PingInterval time.Duration
+	// Время ожидания ответа на ping. По умолчанию DefaultPingTimeout.
+	PingTimeout time.Duration
+	// Минимальное количество воркеров при автоматическом масштабировании.
+	// По умолчанию равно n, переданному в Start. Если оно больше n, то пул
+	// сразу запускает MinWorkers воркеров. Не может быть больше MaxWorkers.
+	MinWorkers int
+	// Максимальное количество воркеров. Если значение больше n, переданного
+	// в Start, то пул автоматически добавляет воркеры при росте очереди и
+	// останавливает простаивающие.
+	MaxWorkers int
+	// Количество задач в очереди, при котором пул добавляет воркер. По
+	// умолчанию 1, т.е. любая ожидающая задача.
+	ScaleUpQueue int
+	// Время ожидания задачи в очереди, при превышении которого пул добавляет
+	// воркер. По умолчанию DefaultScaleUpWait.
+	ScaleUpWait time.Duration
+	// Время простоя, после которого лишний воркер останавливается. По
+	// умолчанию DefaultScaleDownIdle.
+	ScaleDownIdle time.Duration
+	// Период принятия решений о масштабировании. По умолчанию
+	// DefaultScaleInterval.
+	ScaleInterval time.Duration
+	// Количество неудачных запусков и неожиданных завершений воркеров за
+	// CrashLoopWindow, после которого пул считается деградировавшим (см.
+	// Degraded). По умолчанию DefaultCrashLoopThreshold.
+	CrashLoopThreshold int
+	// Период, за который учитываются неудачные запуски и неожиданные
+	// завершения воркеров. По умолчанию DefaultCrashLoopWindow.
+	CrashLoopWindow time.Duration
+	// Количество воркеров, одновременно заменяемых при Reload. По
+	// умолчанию 1.
+	ReloadBatch int
+	// Количество неудачных запусков новых воркеров подряд, после которого
+	// Reload прерывается. По умолчанию DefaultReloadMaxFailures.
+	ReloadMaxFailures int
+
+	pool []*Worker
+	// Внешние воркеры, подключившиеся через Serve. Не участвуют в
+	// масштабировании, перезагрузке и контроле памяти.
+	external []*Worker
+	queue    chan WorkerJob
+	// Количество задач в общей очереди без учета получивших
+	// ErrQueueTimeout.
+	depth  atomic.Int64
+	dropMu sync.Mutex
+	done   chan struct{}
+	argv   []string
+	env    []string
+	mu     sync.Mutex
+	// Не дает запускать несколько Reload одновременно.
+	reloadMu sync.Mutex
+	// Не дает закрыть очередь во время отправки в нее задачи.
+	sendMu sync.RWMutex
+	// Планировщик дорожек или nil, если дорожки не заданы.
+	sched *scheduler
+	// Кольцо хэшей воркеров для WithAffinity. Сбрасывается при изменении
+	// состава пула и строится заново при необходимости.
+	ring *hashRing
+	// Последний выданный идентификатор воркера.
+	lastID atomic.Uint64
+	// Время недавних падений воркеров и состояние деградации пула.
+	failures []time.Time
+	degraded bool
+	failMu   sync.Mutex
+	// Максимальное время ожидания задачи в очереди (в наносекундах) с
+	// момента последней проверки масштабирования.
+	maxWait atomic.Int64
+	// Статистика ожидания задач в очереди за все время работы пула.
+	waitCount atomic.Uint64
+	waitTotal atomic.Int64
+	waitPeak  atomic.Int64
 }
 
-// Start запускает n воркеров, указанных в argv с переменными окружения env.
-// Повторный запуск возможен только после выполнения Stop.
+// Start запускает n воркеров (но не меньше MinWorkers), указанных в argv с
+// переменными окружения env. Повторный запуск возможен только после
+// выполнения Stop.
 func (p *Pool) Start(argv []string, n int, env []string) error {
 	if len(p.pool) != 0 {
 		return errors.New("already started")
 	}
-	p.queue = make(chan WorkerJob, n*512)
+	if p.MaxWorkers > 0 && p.MinWorkers > p.MaxWorkers {
+		return fmt.Errorf(
+			"MinWorkers %d is greater than MaxWorkers %d",
+			p.MinWorkers,
+			p.MaxWorkers,
+		)
+	}
+	n = max(n, p.MinWorkers)
+	if err := p.Isolation.setupCgroup(); err != nil {
+		return err
+	}
+	p.argv = argv
+	p.env = env
+	capacity := max(n, p.MaxWorkers) * 512
+	p.sched = nil
+	if len(p.Lanes) > 0 {
+		// Задачи ждут в очередях дорожек, а общая очередь только
+		// передает их воркерам.
+		p.queue = make(chan WorkerJob)
+		sched, err := newScheduler(p.Lanes, p.MaxQueue, capacity, p.queue)
+		if err != nil {
+			return err
+		}
+		p.sched = sched
+	} else if p.MaxQueue > 0 {
+		// Задачи, получившие ErrQueueTimeout, не учитываются в MaxQueue,
+		// но занимают место в канале, пока их не отбросят воркеры.
+		p.queue = make(chan WorkerJob, p.MaxQueue+capacity)
+	} else {
+		p.queue = make(chan WorkerJob, capacity)
+	}
+	p.depth.Store(0)
+	p.done = make(chan struct{})
+	if p.sched != nil {
+		go p.sched.run(p.done)
+	}
 	var wg sync.WaitGroup
 	wg.Add(n)
+	var mu sync.Mutex
 	var werr error
 	for i := 0; i < n; i++ {
 		go func() {
 			defer wg.Done()
-			wrk := NewWorker(p.queue)
-			start := time.Now()
-			err := wrk.Start(argv, env)
-			if err != nil {
+			if err := p.spawn(); err != nil {
+				mu.Lock()
 				werr = err
-				return
+				mu.Unlock()
 			}
-			p.mu.Lock()
-			p.pool = append(p.pool, wrk)
-			p.mu.Unlock()
-			log.Printf(
-				"PID %d: worker started in %s",
-				wrk.cmd.Process.Pid,
-				time.Since(start),
-			)
 		}()
 	}
 	wg.Wait()
+	if p.MemorySoftLimit > 0 || p.MemoryHardLimit > 0 {
+		go p.watchMemory(p.done)
+	}
+	if p.MaxWorkers > n {
+		go p.autoscale(p.done, n)
+	}
+	if p.PingInterval > 0 {
+		go p.probeIdle(p.done)
+	}
 	return werr
 }
 
@@ -71,35 +298,677 @@ func (p *Pool) Start(argv []string, n int, env []string) error {
 // канал, из которого можно получить ответ от воркера. Если ответ не получен
 // через timeout, воркер перезапускается и возвращается ошибка.
 func (p *Pool) Send(data []byte, timeout time.Duration) chan WorkerResult {
-	res := make(chan WorkerResult)
-	p.queue <- WorkerJob{data: data, res: res, timeout: timeout}
+	return p.SendContext(context.Background(), data, timeout)
+}
+
+// SendContext работает как Send, но позволяет отменить задачу через ctx. Если
+// ctx отменен, пока задача ждет в очереди, то она не выполняется и
+// освобождает место в очереди, а в канал сразу возвращается ошибка ctx.Err().
+// Если ctx отменен во время выполнения задачи,
+// то поведение определяется CancelPolicy.
+func (p *Pool) SendContext(
+	ctx context.Context, data []byte, timeout time.Duration,
+) chan WorkerResult {
+	return p.SendStream(ctx, data, timeout, nil)
+}
+
+// SendStream работает как SendContext, но позволяет процессу отправлять ответ
+// частями (только в версии 2 протокола, см. frame.go). onChunk вызывается для
+// каждой части до того, как в канал придет окончательный ответ, а timeout
+// отсчитывается заново после каждой части. Если onChunk возвращает ошибку,
+// то остальные части отбрасываются. Процессы, не поддерживающие потоковые
+// ответы, просто возвращают окончательный ответ.
+func (p *Pool) SendStream(
+	ctx context.Context,
+	data []byte,
+	timeout time.Duration,
+	onChunk func([]byte) error,
+) chan WorkerResult {
+	// Буфер нужен, чтобы воркер не зависал на отправке ответа, который уже
+	// никто не ждет.
+	res := make(chan WorkerResult, 1)
+	job := WorkerJob{
+		ctx:     ctx,
+		data:    data,
+		res:     res,
+		onChunk: onChunk,
+		timeout: timeout,
+		queued:  time.Now(),
+		state:   &jobState{},
+	}
+	var cancelled <-chan struct{}
+	if ctx != nil {
+		cancelled = ctx.Done()
+	}
+	if cancelled != nil || p.MaxQueueWait > 0 {
+		job.state.taken = make(chan struct{})
+	}
+	select {
+	case <-p.done:
+		res <- WorkerResult{Err: ErrPoolStopped}
+		return res
+	default:
+	}
+	queue, maxQueue, depth := p.queue, p.MaxQueue, &p.depth
+	if p.sched != nil {
+		l := p.sched.lane(ctx)
+		queue, maxQueue, depth = l.queue, l.MaxQueue, &l.depth
+	}
+	// Задача, ожидающая предпочтительного воркера, тоже занимает место в
+	// очереди и может получить ErrQueueTimeout.
+	if !reserve(depth, maxQueue) {
+		res <- WorkerResult{Err: ErrQueueFull}
+		return res
+	}
+	job.state.depth = depth
+	if p.MaxQueueWait > 0 {
+		t := time.AfterFunc(p.MaxQueueWait, func() {
+			if job.claim() {
+				res <- WorkerResult{Err: ErrQueueTimeout}
+			}
+		})
+		job.state.timer.Store(t)
+		// Воркер мог взять задачу до сохранения таймера.
+		if job.state.claimed.Load() {
+			t.Stop()
+		}
+	}
+	if cancelled != nil {
+		// Отмененная задача сразу освобождает место в очереди, а
+		// вызывающий получает ошибку, не дожидаясь свободного воркера.
+		go func() {
+			select {
+			case <-cancelled:
+				if job.claim() {
+					res <- WorkerResult{Err: ctx.Err()}
+				}
+			case <-job.state.taken:
+			}
+		}()
+	}
+	fail := func(err error) chan WorkerResult {
+		if job.claim() {
+			res <- WorkerResult{Err: err}
+		}
+		return res
+	}
+	// Предпочтительного воркера ждем без блокировки, чтобы не задерживать
+	// остановку пула.
+	if wrk := p.affine(ctx); wrk != nil && p.sendAffine(wrk, job) {
+		return res
+	}
+	// Задача уже получила ErrQueueTimeout или ее отменили.
+	if job.state.claimed.Load() {
+		return res
+	}
+	// Очередь закрывается при остановке пула только после получения
+	// полной блокировки, поэтому отправка в закрытую очередь невозможна.
+	p.sendMu.RLock()
+	select {
+	case <-p.done:
+		p.sendMu.RUnlock()
+		return fail(ErrPoolStopped)
+	default:
+	}
+	if maxQueue > 0 {
+		select {
+		case queue <- job:
+		default:
+			// Место в очереди занимают задачи, которые уже получили
+			// ErrQueueTimeout или были отменены, но еще не отброшены
+			// воркерами.
+			p.dropClaimed(queue)
+			select {
+			case queue <- job:
+			default:
+				p.sendMu.RUnlock()
+				return fail(ErrQueueFull)
+			}
+		}
+	} else {
+		select {
+		case queue <- job:
+		case <-p.done:
+			p.sendMu.RUnlock()
+			return fail(ErrPoolStopped)
+		case <-job.state.taken:
+			// Задачу отменили или она получила ErrQueueTimeout.
+			p.sendMu.RUnlock()
+			return res
+		}
+	}
+	p.sendMu.RUnlock()
+	if p.sched != nil {
+		p.sched.notify()
+	}
 	return res
 }
 
-// Stop останавливает все запущенные процессы и очищает пул.
+// dropClaimed убирает из очереди queue задачи, которые уже получили
+// ErrQueueTimeout или были отменены. Остальные задачи возвращаются в конец очереди.
+func (p *Pool) dropClaimed(queue chan WorkerJob) {
+	p.dropMu.Lock()
+	defer p.dropMu.Unlock()
+	for n := len(queue); n > 0; n-- {
+		var job WorkerJob
+		select {
+		case job = <-queue:
+		default:
+			return
+		}
+		if job.state != nil && job.state.claimed.Load() {
+			continue
+		}
+		select {
+		case queue <- job:
+		default:
+			// Освободившееся место заняла новая задача.
+			if job.claim() {
+				job.res <- WorkerResult{Err: ErrQueueFull}
+			}
+		}
+	}
+}
+
+// reserve увеличивает длину очереди depth, если она меньше limit (при 0 --
+// без ограничения). Возвращает false, если очередь заполнена.
+func reserve(depth *atomic.Int64, limit int) bool {
+	for {
+		cur := depth.Load()
+		if limit > 0 && cur >= int64(limit) {
+			return false
+		}
+		if depth.CompareAndSwap(cur, cur+1) {
+			return true
+		}
+	}
+}
+
+// newWorker создает воркер, слушающий очередь пула, с настройками пула.
+func (p *Pool) newWorker() *Worker {
+	wrk := NewWorker(p.queue)
+	wrk.MaxJobs = p.MaxJobs
+	wrk.MaxUptime = p.MaxUptime
+	wrk.CancelPolicy = p.CancelPolicy
+	wrk.TimeoutGrace = p.TimeoutGrace
+	wrk.TimeoutSignal = p.TimeoutSignal
+	wrk.Concurrency = p.Concurrency
+	wrk.Services = p.Services
+	wrk.Transport = p.Transport
+	wrk.MaxMessageSize = p.MaxMessageSize
+	wrk.Name = p.Name
+	wrk.App = p.App
+	wrk.Token = p.WorkerToken
+	wrk.RequiredJobs = p.RequiredJobs
+	wrk.LogSink = p.LogSink
+	wrk.LogMaxLine = p.LogMaxLine
+	wrk.Isolation = p.Isolation
+	wrk.PingTimeout = p.PingTimeout
+	wrk.id = p.lastID.Add(1)
+	wrk.pool = p
+	return wrk
+}
+
+// spawn запускает новый воркер и добавляет его в пул.
+func (p *Pool) spawn() error {
+	wrk := p.newWorker()
+	start := time.Now()
+	if err := wrk.Start(p.argv, p.env); err != nil {
+		p.recordFailure()
+		return err
+	}
+	p.mu.Lock()
+	p.pool = append(p.pool, wrk)
+	p.ring = nil
+	p.mu.Unlock()
+	log.Printf(
+		"PID %d: worker started in %s",
+		wrk.Pid(),
+		time.Since(start),
+	)
+	return nil
+}
+
+// remove убирает воркер из пула и штатно останавливает его после выполнения
+// текущей задачи. Если воркера уже нет в пуле, ничего не делает.
+func (p *Pool) remove(wrk *Worker) {
+	p.mu.Lock()
+	found := false
+	for i, w := range p.pool {
+		if w == wrk {
+			p.pool = append(p.pool[:i], p.pool[i+1:]...)
+			p.ring = nil
+			found = true
+			break
+		}
+	}
+	p.mu.Unlock()
+	if found {
+		wrk.retire()
+	}
+}
+
+// queueLength возвращает количество задач, ожидающих воркер.
+func (p *Pool) queueLength() int {
+	if p.sched != nil {
+		_, queued, _ := p.sched.stats()
+		return queued
+	}
+	return int(p.depth.Load())
+}
+
+// queueCapacity возвращает размер общей очереди.
+func (p *Pool) queueCapacity() int {
+	if p.MaxQueue > 0 {
+		return p.MaxQueue
+	}
+	return cap(p.queue)
+}
+
+// stopping сообщает, что пул останавливается или остановлен.
+func (p *Pool) stopping() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// workers возвращает копию списка воркеров пула.
+func (p *Pool) workers() []*Worker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wrks := make([]*Worker, len(p.pool))
+	copy(wrks, p.pool)
+	return wrks
+}
+
+// observeWait учитывает время ожидания задачи в очереди.
+func (p *Pool) observeWait(wait time.Duration) {
+	p.waitCount.Add(1)
+	p.waitTotal.Add(int64(wait))
+	storeMax(&p.waitPeak, int64(wait))
+	storeMax(&p.maxWait, int64(wait))
+}
+
+// storeMax атомарно записывает val в v, если val больше текущего значения.
+func storeMax(v *atomic.Int64, val int64) {
+	for {
+		cur := v.Load()
+		if val <= cur || v.CompareAndSwap(cur, val) {
+			return
+		}
+	}
+}
+
+// Stop перестает принимать задачи, дожидается выполнения оставшихся в очереди,
+// после чего останавливает все запущенные процессы, отключает внешние и
+// очищает пул. Задачи, которые некому выполнить, например, если воркеров не
+// осталось, завершаются с ErrPoolStopped.
 func (p *Pool) Stop() {
+	close(p.done)
+	// Дожидаемся начатых отправок задач, новые увидят закрытый done.
+	p.sendMu.Lock()
+	p.sendMu.Unlock()
+	if p.sched != nil {
+		p.waitScheduler()
+	}
 	close(p.queue)
-	for _, wrk := range p.pool {
-		wrk.Stop()
+	for _, wrk := range p.workers() {
+		wrk.retire()
+	}
+	for _, wrk := range p.externalWorkers() {
+		wrk.retire()
+	}
+	// Циклы обработки задач завершены, оставшиеся в очереди задачи
+	// больше никто не возьмет.
+	for job := range p.queue {
+		job.fail(ErrPoolStopped)
 	}
+	if err := p.Isolation.removeCgroup(); err != nil {
+		log.Printf("pool: could not remove cgroup: %s", err)
+	}
+	p.mu.Lock()
 	p.pool = []*Worker{}
+	p.ring = nil
+	p.external = []*Worker{}
+	p.mu.Unlock()
+}
+
+// waitScheduler дожидается, пока планировщик передаст воркерам оставшиеся в
+// дорожках задачи. Если воркеров не осталось, задачи завершаются с
+// ErrPoolStopped.
+func (p *Pool) waitScheduler() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if len(p.workers())+len(p.externalWorkers()) == 0 {
+			p.sched.cancel()
+		}
+		select {
+		case <-p.sched.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown работает как Stop, то есть дожидается выполнения задач из очереди и
+// штатно останавливает процессы, но если они не успевают до отмены ctx, то
+// процессы убиваются, а оставшиеся задачи завершаются с ошибкой. Возвращает
+// ctx.Err(), если пришлось убивать процессы.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+	}
+	for _, wrk := range append(p.workers(), p.externalWorkers()...) {
+		wrk.terminate()
+	}
+	if p.sched != nil {
+		p.sched.cancel()
+	}
+	<-stopped
+	return ctx.Err()
+}
+
+// Serve принимает на l подключения внешних воркеров и добавляет их в пул, пока
+// l не будет закрыт. Внешние воркеры -- самостоятельно запущенные процессы,
+// например, в другом контейнере или под другим супервизором, которые
+// подключаются к адресу l и проходят то же подтверждение готовности, что и
+// запускаемые пулом. Они берут задачи из общей очереди, но не перезапускаются
+// пулом: при отключении или ошибке воркер просто удаляется из пула. Пул должен
+// быть запущен через Start, возможно, с n = 0.
+//
+// Внешние воркеры получают запросы со всеми данными пользователей, поэтому без
+// WorkerToken подключения принимаются только с локальных адресов.
+func (p *Pool) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.attach(conn)
+	}
+}
+
+// attach подключает внешний воркер и добавляет его в пул.
+func (p *Pool) attach(conn net.Conn) {
+	if p.WorkerToken == "" && !isLocal(conn) {
+		log.Printf(
+			"pool: external worker %s refused: not a local address and no worker token set",
+			remoteAddr(conn),
+		)
+		conn.Close()
+		return
+	}
+	wrk := p.newWorker()
+	if err := wrk.attach(conn); err != nil {
+		log.Printf(
+			"pool: external worker %s failed to start: %s",
+			remoteAddr(conn), err,
+		)
+		return
+	}
+	p.mu.Lock()
+	p.external = append(p.external, wrk)
+	p.mu.Unlock()
+	go wrk.jobLoop()
+	log.Printf(
+		"PID %d: external worker connected from %s",
+		wrk.Pid(), remoteAddr(conn),
+	)
+}
+
+// remoteAddr возвращает адрес внешнего воркера для логов. У клиентов
+// Unix-сокетов адреса обычно нет, поэтому для них возвращается адрес сокета.
+func remoteAddr(conn net.Conn) string {
+	if a := conn.RemoteAddr().String(); a != "" && a != "@" {
+		return a
+	}
+	return conn.LocalAddr().String()
+}
+
+// isLocal сообщает, что внешний воркер подключился через Unix-сокет или с
+// loopback-адреса.
+func isLocal(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	return !ok || addr.IP.IsLoopback()
+}
+
+// detach убирает отключившийся внешний воркер из пула.
+func (p *Pool) detach(wrk *Worker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, w := range p.external {
+		if w == wrk {
+			p.external = append(p.external[:i], p.external[i+1:]...)
+			return
+		}
+	}
+}
+
+// externalWorkers возвращает копию списка внешних воркеров пула.
+func (p *Pool) externalWorkers() []*Worker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wrks := make([]*Worker, len(p.external))
+	copy(wrks, p.external)
+	return wrks
 }
 
 type Worker struct {
-	cmd   *exec.Cmd
+	// Количество задач, после выполнения которых процесс перезапускается.
+	// При 0 количество задач не ограничивается.
+	MaxJobs int
+	// Время работы процесса, после которого он перезапускается, даже если
+	// простаивает. Занятый процесс дорабатывает текущую задачу. При 0 время
+	// работы не ограничивается.
+	MaxUptime time.Duration
+	// Поведение при отмене контекста выполняющейся задачи. По умолчанию
+	// CancelWait. В режиме мультиплексирования процесс не убивается, а
+	// задача просто перестает ждать ответ.
+	CancelPolicy CancelPolicy
+	// Отсрочка перед убийством процесса, не выполнившего задачу за timeout.
+	// При превышении timeout процесс получает TimeoutSignal и может за это
+	// время вернуть ответ с ошибкой или завершиться, например, откатив
+	// транзакции. Процесс, ответивший во время отсрочки, штатно
+	// перезапускается после задачи. Не действует для внешних процессов и
+	// процессов, выполняющих несколько задач одновременно. При 0 процесс
+	// убивается сразу.
+	TimeoutGrace time.Duration
+	// Сигнал, который процесс получает при превышении timeout. По умолчанию
+	// SIGTERM.
+	TimeoutSignal os.Signal
+	// Максимальное количество одновременно выполняемых задач, если процесс
+	// поддерживает мультиплексирование. По умолчанию 1.
+	Concurrency int
+	// Сервисы Go, доступные процессу (см. services.go).
+	Services *Services
+
+	// Транспорт для связи с запускаемыми процессами. По умолчанию
+	// StdioTransport.
+	Transport Transport
+	// Максимальный размер сообщения от процесса. По умолчанию
+	// DefaultMaxMessageSize.
+	MaxMessageSize int
+	// Название пула для логов процесса.
+	Name string
+	// Приложение, сборка и задачи, которые процесс должен заявить в
+	// приветствии (см. Pool.App). Воркеры пула проверяют сборку пула, а не
+	// Build.
+	App          string
+	Build        string
+	RequiredJobs []string
+	// Секрет, который внешний процесс должен сообщить в приветствии (см.
+	// Attach). Пустое значение не проверяется.
+	Token string
+	// Получатель логов процесса. По умолчанию TextLogSink.
+	LogSink LogSink
+	// Максимальная длина записи лога процесса. По умолчанию
+	// DefaultLogMaxLine.
+	LogMaxLine int
+	// Пользователь и ограничения ресурсов процесса (см. Isolation).
+	Isolation Isolation
+	// Время ожидания ответа на ping (см. Pool.PingInterval). По умолчанию
+	// DefaultPingTimeout.
+	PingTimeout time.Duration
+
+	// Текущий процесс или nil, если процесс не запущен.
+	proc  *process
 	read  *bufio.Reader
 	write *bufio.Writer
-	mu    sync.Mutex
-	argv  []string
-	env   []string
-	queue chan WorkerJob
+	// Блокирует чтение и запись в процесс на время обмена сообщениями.
+	mu sync.Mutex
+	// Блокирует запуск, остановку и перезапуск процесса. Если нужны обе
+	// блокировки, life захватывается первой.
+	life sync.Mutex
+	// Результат завершения текущего процесса.
+	exit *procExit
+	// То же, что proc, но доступно без блокировки life, которую Stop
+	// удерживает до завершения процесса.
+	running atomic.Pointer[process]
+	// Процесс убит при остановке пула, новый запускать не нужно.
+	terminated atomic.Bool
+	// Согласованная с процессом версия протокола.
+	proto int
+	// Процесс отвечает на кадры framePing.
+	pings bool
+	// Приветствие текущего процесса для статистики.
+	hello atomic.Pointer[handshake]
+	// Соединение с процессом в режиме мультиплексирования или версии 2
+	// протокола, иначе nil.
+	mux *muxConn
+	// Согласованное с процессом количество одновременно выполняемых задач.
+	conc atomic.Int32
+	// Сообщения о завершении задач, выполняемых в отдельных горутинах.
+	finished chan struct{}
+	// Количество падений подряд и время последнего падения для расчета
+	// задержки перед повторным запуском.
+	crashes   int
+	lastCrash time.Time
+	argv      []string
+	env       []string
+	queue     chan WorkerJob
+	// Задачи, переданные именно этому воркеру (см. WithAffinity).
+	affine chan WorkerJob
+	// Идентификатор воркера в пуле для кольца хэшей.
+	id uint64
+	// Количество выполненных текущим процессом задач.
+	jobs int
+	// Время запуска текущего процесса (в наносекундах Unix).
+	started atomic.Int64
+	// Запускался ли процесс хотя бы раз. Нужно для подсчета перезапусков.
+	spawned bool
+	// PID текущего процесса. Хранится отдельно от proc, чтобы его можно было
+	// получить без блокировки mu, которая удерживается на время задачи.
+	pid atomic.Int64
+	// Текущее состояние воркера (WorkerState).
+	state atomic.Int32
+	// Время начала выполнения текущей задачи (в наносекундах Unix).
+	jobStart atomic.Int64
+	// Идентификатор запроса текущей задачи (string) для логов.
+	request atomic.Value
+	// Счетчики для статистики за все время работы воркера.
+	served    atomic.Uint64
+	jobErrors atomic.Uint64
+	timeouts  atomic.Uint64
+	restarts  atomic.Uint64
+	// Запрос на перезапуск процесса между задачами с указанием причины.
+	recycleCh chan string
+	// Запрос на проверку простаивающего процесса (см. probe).
+	probeCh chan struct{}
+	// Время окончания последней задачи (в наносекундах Unix).
+	lastActive atomic.Int64
+	// Закрывается для завершения цикла обработки задач.
+	quit     chan struct{}
+	quitOnce sync.Once
+	// Закрывается после завершения цикла обработки задач.
+	done chan struct{}
+	// Процессы, завершение которых обнаружил супервизор.
+	crashed chan *process
+	// Пул, которому принадлежит воркер. nil для самостоятельных воркеров.
+	pool *Pool
+	// Воркер обслуживает внешний процесс, подключившийся самостоятельно
+	// (см. Attach), и не может перезапустить его.
+	external bool
 }
 
 // Задача на обработку для запущенного процесса.
 type WorkerJob struct {
+	ctx     context.Context
 	data    []byte
 	timeout time.Duration
 	res     chan WorkerResult
+	// Получатель частей потокового ответа или nil.
+	onChunk func([]byte) error
+	// Время постановки задачи в очередь.
+	queued time.Time
+	// Общее для всех копий задачи состояние.
+	state *jobState
+	// Вызывается после выполнения задачи или отказа от нее, если задача
+	// пришла из дорожки (см. Lane).
+	release func()
+}
+
+// done сообщает о завершении задачи дорожке, из которой она пришла.
+func (job *WorkerJob) done() {
+	if job.release != nil {
+		job.release()
+	}
+}
+
+// fail завершает задачу с ошибкой err, если ее еще не взял кто-то другой.
+func (job *WorkerJob) fail(err error) {
+	if job.claim() {
+		job.res <- WorkerResult{Err: err}
+	}
+	job.done()
+}
+
+// Состояние задачи, ожидающей в очереди.
+type jobState struct {
+	// Устанавливается воркером, взявшим задачу, или таймером MaxQueueWait.
+	// Кто первый установил, тот и отвечает на задачу.
+	claimed atomic.Bool
+	// Таймер MaxQueueWait или nil.
+	timer atomic.Pointer[time.Timer]
+	// Закрывается при взятии задачи, если задачу можно отменить или у нее
+	// есть MaxQueueWait, иначе nil.
+	taken chan struct{}
+	// Длина очереди, в которой ждет задача, или nil, если задача передана
+	// воркеру напрямую.
+	depth *atomic.Int64
+}
+
+// claim помечает задачу как взятую, останавливает таймер MaxQueueWait и
+// убирает задачу из длины очереди. Возвращает false, если задачу уже взял
+// кто-то другой.
+func (job *WorkerJob) claim() bool {
+	s := job.state
+	if s == nil {
+		return true
+	}
+	if !s.claimed.CompareAndSwap(false, true) {
+		return false
+	}
+	if t := s.timer.Load(); t != nil {
+		t.Stop()
+	}
+	if s.taken != nil {
+		close(s.taken)
+	}
+	if s.depth != nil {
+		s.depth.Add(-1)
+	}
+	return true
 }
 
 // Результат выполнения WorkerJob.
@@ -109,22 +978,102 @@ type WorkerResult struct {
 }
 
 func NewWorker(queue chan WorkerJob) *Worker {
-	return &Worker{queue: queue}
+	return &Worker{
+		queue:     queue,
+		affine:    make(chan WorkerJob),
+		recycleCh: make(chan string, 1),
+		probeCh:   make(chan struct{}, 1),
+		crashed:   make(chan *process),
+		finished:  make(chan struct{}),
+	}
 }
 
-// Start запускает процесс с указанными аргументами argv. Этот метод не
-// дожидается завершения процесса.
-// XXX: переделать в блокирующий метод? Будет проще отслеживать завершение
-// процесса (сейчас это реализовано отловом EOF в любом из pipe'ов).
-// exec.Run(), судя по всему, не дает параллельно читать pipe'ы, как и
-// последовательный запуск exec.Start() и exec.Wait().
+// expectedBuild возвращает сборку, которую должен сообщить процесс. Сборка
+// пула может измениться при ReloadBuild, в том числе для уже запущенных
+// воркеров, перезапускающих процессы.
+func (wrk *Worker) expectedBuild() string {
+	if wrk.pool != nil {
+		return wrk.pool.expectedBuild()
+	}
+	return wrk.Build
+}
+
+// Pid возвращает PID запущенного процесса или 0, если процесс не запущен.
+func (wrk *Worker) Pid() int {
+	return int(wrk.pid.Load())
+}
+
+// Start запускает процесс с указанными аргументами argv и цикл обработки
+// задач из очереди. Этот метод не дожидается завершения процесса.
 func (wrk *Worker) Start(argv []string, env []string) error {
-	if wrk.cmd != nil {
+	wrk.quit = make(chan struct{})
+	wrk.quitOnce = sync.Once{}
+	wrk.done = make(chan struct{})
+	wrk.life.Lock()
+	err := wrk.start(argv, env)
+	wrk.life.Unlock()
+	if err != nil {
+		close(wrk.done)
+		return err
+	}
+	// Запуск бесконечного цикла обработки сообщений.
+	go wrk.jobLoop()
+	return nil
+}
+
+// Attach подключает воркер к внешнему процессу, который сам установил
+// соединение conn, и запускает цикл обработки задач. Процесс должен пройти то
+// же подтверждение готовности, что и запускаемые процессы. Воркер не может
+// перезапустить внешний процесс: при отключении, ошибке или превышении
+// ограничений соединение закрывается, а цикл обработки задач завершается.
+func (wrk *Worker) Attach(conn net.Conn) error {
+	if err := wrk.attach(conn); err != nil {
+		return err
+	}
+	go wrk.jobLoop()
+	return nil
+}
+
+// attach работает как Attach, но не запускает цикл обработки задач.
+func (wrk *Worker) attach(conn net.Conn) error {
+	wrk.quit = make(chan struct{})
+	wrk.quitOnce = sync.Once{}
+	wrk.done = make(chan struct{})
+	wrk.life.Lock()
+	defer wrk.life.Unlock()
+	wrk.external = true
+	wrk.setState(WorkerStarting)
+	// Не ждем подтверждения готовности бесконечно.
+	conn.SetDeadline(time.Now().Add(socketConnectTimeout))
+	err := wrk.handshake(&process{conn: newExtConn(conn)})
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		close(wrk.done)
+	}
+	return err
+}
+
+// disconnected сообщает, что внешний процесс отключился.
+func (wrk *Worker) disconnected() bool {
+	wrk.life.Lock()
+	defer wrk.life.Unlock()
+	return wrk.proc == nil
+}
+
+// start запускает процесс и дожидается от него готовности к работе. В отличие
+// от Start не запускает цикл обработки задач, поэтому используется и при
+// перезапуске процесса. Вызывается с захваченной блокировкой life.
+func (wrk *Worker) start(argv []string, env []string) error {
+	if wrk.proc != nil {
 		return errors.New("already started")
 	}
+	if wrk.external {
+		return errExternal
+	}
 
 	wrk.argv = argv
 	wrk.env = env
+	wrk.setState(WorkerStarting)
 	var cmd *exec.Cmd
 	if len(argv) == 1 {
 		cmd = exec.Command(argv[0])
@@ -132,121 +1081,514 @@ func (wrk *Worker) Start(argv []string, env []string) error {
 		cmd = exec.Command(argv[0], argv[1:]...)
 	}
 	cmd.Env = env
-	stdout, err := cmd.StdoutPipe()
+	cmd.SysProcAttr = wrk.Isolation.sysProcAttr()
+	gate, err := wrk.Isolation.gate(cmd)
 	if err != nil {
+		wrk.reset()
 		return err
 	}
-	wrk.read = bufio.NewReader(stdout)
-
-	stdin, err := cmd.StdinPipe()
+	// Вывод процесса идет в лог через собственные pipe, а не через
+	// StdoutPipe, чтобы транспорт мог переопределить stdout.
+	stdout, stdoutW, err := os.Pipe()
 	if err != nil {
+		wrk.reset()
 		return err
 	}
-	wrk.write = bufio.NewWriter(stdin)
-
-	stderr, err := cmd.StderrPipe()
+	stderr, stderrW, err := os.Pipe()
 	if err != nil {
+		stdout.Close()
+		stdoutW.Close()
+		wrk.reset()
 		return err
 	}
-	errReader := bufio.NewReader(stderr)
-	// Параллельно запускаем чтение и вывод ошибок приложения.
-	go func() {
-		for {
-			l, err := errReader.ReadString('\n')
-			if err != nil {
-				if err != io.EOF {
-					log.Println("logging error: ", err)
-				}
-				break
-			}
-			log.Print(l)
-		}
-	}()
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
 
-	if err = cmd.Start(); err != nil {
+	transport := wrk.Transport
+	if transport == nil {
+		transport = StdioTransport{}
+	}
+	conn, err := transport.Connect(cmd)
+	// Копии для процесса больше не нужны, без их закрытия чтение не
+	// получит EOF после завершения процесса.
+	stdoutW.Close()
+	stderrW.Close()
+	gate.started()
+	if cmd.Process != nil {
+		// Параллельно запускаем чтение и вывод логов приложения.
+		l := wrk.procLog(cmd.Process.Pid)
+		go l.capture(stdout, "stdout")
+		go l.capture(stderr, "stderr")
+	} else {
+		stdout.Close()
+		stderr.Close()
+	}
+	if err != nil {
+		if cmd.Process != nil {
+			// Не оставляем за собой зомби-процессы.
+			killProcess(cmd.Process)
+			cmd.Wait()
+		}
+		wrk.reset()
 		return err
 	}
+	proc := &process{cmd: cmd, conn: conn, pid: cmd.Process.Pid}
+	if err := gate.wait(); err != nil {
+		proc.kill()
+		proc.wait()
+		wrk.reset()
+		return err
+	}
+	return wrk.handshake(proc)
+}
+
+// handshake дожидается от процесса proc готовности к работе, согласует с ним
+// протокол и делает его текущим процессом воркера. Вызывается с захваченной
+// блокировкой life.
+func (wrk *Worker) handshake(proc *process) error {
+	wrk.read = bufio.NewReader(proc.conn)
+	wrk.write = bufio.NewWriter(proc.conn)
 	ok, err := wrk.read.ReadString('\n')
+	var h handshake
+	if err == nil {
+		if h, err = parseHandshake(ok); err != nil {
+			// Вместо подтверждения процесс вывел что-то другое,
+			// скорее всего ошибку.
+			msg, _ := io.ReadAll(wrk.read)
+			err = errors.New(ok + string(msg))
+		}
+	}
+	var proto, mux int
+	var reply string
+	if err == nil {
+		proto, mux, reply, err = h.negotiate(wrk.Concurrency)
+	}
+	if err == nil {
+		err = h.check(proto, wrk.App, wrk.expectedBuild(), wrk.RequiredJobs)
+	}
+	if err == nil && wrk.external {
+		err = h.checkToken(wrk.Token)
+	}
+	if sc, ok := proc.conn.(*socketConn); ok && err == nil {
+		err = h.checkToken(sc.token)
+	}
+	if err == nil && reply != "" {
+		_, err = wrk.write.WriteString(reply)
+		if err == nil {
+			err = wrk.write.Flush()
+		}
+	}
 	if err != nil {
+		// Не оставляем за собой зомби-процессы.
+		proc.kill()
+		proc.wait()
+		wrk.reset()
 		return err
 	}
-	if string(ok) != "ok\n" {
-		msg, _ := io.ReadAll(wrk.read)
-		return errors.New(string(msg))
+	if proc.cmd == nil {
+		// Внешний процесс может сообщить свой PID, например, для
+		// логов.
+		proc.pid = h.pid
+	}
+	wrk.proc = proc
+	wrk.running.Store(proc)
+	wrk.exit = &procExit{done: make(chan struct{})}
+	wrk.pid.Store(int64(proc.pid))
+	wrk.jobs = 0
+	now := time.Now().UnixNano()
+	wrk.started.Store(now)
+	wrk.lastActive.Store(now)
+	if wrk.spawned {
+		wrk.restarts.Add(1)
+	}
+	wrk.spawned = true
+	wrk.proto = proto
+	wrk.pings = h.ping && proto == protoV2
+	wrk.hello.Store(&h)
+	wrk.conc.Store(int32(max(mux, 1)))
+	if mux > 0 || proto == protoV2 {
+		wrk.mux = newMuxConn(
+			proto, wrk.read, wrk.write, &wrk.mu, wrk.Services,
+			wrk.MaxMessageSize, max(mux, 1),
+		)
+		go wrk.mux.readLoop()
+	}
+	wrk.setState(WorkerIdle)
+	go wrk.supervise(proc, wrk.exit)
+	if wrk.MaxUptime > 0 {
+		// Простаивающий процесс не проверяется после задач, поэтому
+		// перезапуск по времени работы запрашивается таймером.
+		time.AfterFunc(wrk.MaxUptime, func() {
+			if wrk.running.Load() == proc {
+				wrk.requestRecycle("max uptime")
+			}
+		})
 	}
-	wrk.cmd = cmd
-	// Запуск бесконечного цикла обработки сообщений.
-	go wrk.jobLoop()
 
 	return nil
 }
 
 func (wrk *Worker) jobLoop() {
+	defer close(wrk.done)
+	// Количество выполняемых сейчас задач.
+	inflight := 0
+	quit := wrk.quit
 	for {
+		// Внешний процесс отключился, воркер больше не нужен.
+		if wrk.external && wrk.disconnected() {
+			wrk.drain(&inflight)
+			if wrk.pool != nil {
+				wrk.pool.detach(wrk)
+			}
+			return
+		}
+		// Не берем новые задачи, пока процесс занят.
+		queue, affine := wrk.queue, wrk.affine
+		if inflight >= int(wrk.conc.Load()) {
+			queue, affine = nil, nil
+		}
 		select {
-		case job, ok := <-wrk.queue:
+		case job, ok := <-queue:
 			if ok == false {
+				wrk.drain(&inflight)
+				wrk.stopLoop()
 				return
 			}
-			job.res <- *wrk.timedSend(job.data, job.timeout)
+			wrk.take(job, &inflight)
+		case job := <-affine:
+			wrk.take(job, &inflight)
+		case <-wrk.finished:
+			inflight--
+			if inflight == 0 {
+				wrk.state.CompareAndSwap(int32(WorkerBusy), int32(WorkerIdle))
+			}
+			if reason := wrk.expired(); reason != "" {
+				wrk.drain(&inflight)
+				wrk.recycle(reason)
+			}
+		case reason := <-wrk.recycleCh:
+			wrk.drain(&inflight)
+			wrk.recycle(reason)
+		case <-wrk.probeCh:
+			// Проверяем только простаивающий процесс.
+			if inflight == 0 {
+				wrk.probe()
+			}
+		case proc := <-wrk.crashed:
+			wrk.handleCrash(proc)
+		case <-quit:
+			if wrk.pool != nil && wrk.pool.stopping() {
+				// Пул останавливается: очередь уже закрыта, но
+				// оставшиеся в ней задачи нужно выполнить.
+				quit = nil
+				continue
+			}
+			wrk.drain(&inflight)
+			wrk.stopLoop()
+			return
 		}
 	}
 }
 
+// take запускает выполнение задачи job, полученной из очереди, если ее еще не
+// взял кто-то другой и не отменили.
+func (wrk *Worker) take(job WorkerJob, inflight *int) {
+	// Задача уже получила ErrQueueTimeout или ее отменили.
+	if !job.claim() {
+		job.done()
+		return
+	}
+	ctx := job.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// Задачу отменили, пока она ждала в очереди.
+	if err := ctx.Err(); err != nil {
+		job.res <- WorkerResult{Err: err}
+		job.done()
+		return
+	}
+	*inflight++
+	wrk.jobStart.Store(time.Now().UnixNano())
+	wrk.state.CompareAndSwap(int32(WorkerIdle), int32(WorkerBusy))
+	if wrk.pool != nil && !job.queued.IsZero() {
+		wrk.pool.observeWait(time.Since(job.queued))
+	}
+	go wrk.runJob(ctx, job)
+}
+
+// runJob выполняет задачу и сообщает о ее завершении циклу обработки задач.
+func (wrk *Worker) runJob(ctx context.Context, job WorkerJob) {
+	// Помечать логи можно, только если процесс выполняет одну задачу.
+	single := wrk.conc.Load() == 1
+	if single {
+		wrk.request.Store(requestID(ctx))
+	}
+	res := wrk.timedSend(ctx, job.data, job.timeout, job.onChunk)
+	if single {
+		wrk.request.Store("")
+	}
+	job.res <- *res
+	job.done()
+	wrk.served.Add(1)
+	wrk.lastActive.Store(time.Now().UnixNano())
+	wrk.finished <- struct{}{}
+}
+
+// procLog возвращает захват вывода процесса pid.
+func (wrk *Worker) procLog(pid int) *procLog {
+	sink := wrk.LogSink
+	if sink == nil {
+		sink = TextLogSink{}
+	}
+	max := wrk.LogMaxLine
+	if max <= 0 {
+		max = DefaultLogMaxLine
+	}
+	return &procLog{
+		sink: sink,
+		pool: wrk.Name,
+		pid:  pid,
+		max:  max,
+		request: func() string {
+			id, _ := wrk.request.Load().(string)
+			return id
+		},
+	}
+}
+
+// drain дожидается завершения всех выполняемых задач.
+func (wrk *Worker) drain(inflight *int) {
+	for ; *inflight > 0; *inflight-- {
+		<-wrk.finished
+	}
+	wrk.state.CompareAndSwap(int32(WorkerBusy), int32(WorkerIdle))
+}
+
+// stopLoop штатно останавливает процесс при завершении цикла обработки задач.
+func (wrk *Worker) stopLoop() {
+	if err := wrk.Stop(); err != nil && err != errNotRunning {
+		log.Printf("stop error: %s", err)
+	}
+}
+
+// retire завершает цикл обработки задач и штатно останавливает процесс после
+// выполнения текущей задачи. Дожидается остановки.
+func (wrk *Worker) retire() {
+	wrk.quitOnce.Do(func() { close(wrk.quit) })
+	<-wrk.done
+}
+
+// retiring сообщает, что воркер больше не будет выполнять задачи и
+// перезапускать процесс не нужно. При остановке пула воркер сначала выполняет
+// оставшиеся в очереди задачи, если не был убит через terminate.
+func (wrk *Worker) retiring() bool {
+	if wrk.terminated.Load() {
+		return true
+	}
+	select {
+	case <-wrk.quit:
+		return wrk.pool == nil || !wrk.pool.stopping()
+	default:
+		return false
+	}
+}
+
+// terminate немедленно убивает текущий процесс, не дожидаясь блокировки life,
+// и не дает запустить новый. Нужен, чтобы прервать остановку воркера, который
+// не завершается сам.
+func (wrk *Worker) terminate() {
+	wrk.terminated.Store(true)
+	if proc := wrk.running.Load(); proc != nil {
+		log.Printf("PID %d: killing worker (shutdown deadline)", proc.pid)
+		proc.kill()
+	}
+}
+
+// idle возвращает время простоя воркера или 0, если воркер занят задачей.
+func (wrk *Worker) idle() time.Duration {
+	if wrk.State() != WorkerIdle {
+		return 0
+	}
+	return time.Since(time.Unix(0, wrk.lastActive.Load()))
+}
+
+// expired учитывает выполненную задачу и возвращает причину, по которой
+// процесс нужно перезапустить, или пустую строку, если перезапуск не нужен.
+func (wrk *Worker) expired() string {
+	wrk.life.Lock()
+	defer wrk.life.Unlock()
+	if wrk.proc == nil {
+		return ""
+	}
+	wrk.jobs++
+	select {
+	case reason := <-wrk.recycleCh:
+		return reason
+	default:
+	}
+	if wrk.MaxJobs > 0 && wrk.jobs >= wrk.MaxJobs {
+		return "max jobs"
+	}
+	if wrk.MaxUptime > 0 && wrk.uptime() >= wrk.MaxUptime {
+		return "max uptime"
+	}
+	return ""
+}
+
+// requestRecycle просит воркер перезапустить процесс после выполнения текущей
+// задачи или сразу, если воркер простаивает. Возвращает false, если
+// перезапуск уже был запрошен ранее.
+func (wrk *Worker) requestRecycle(reason string) bool {
+	select {
+	case wrk.recycleCh <- reason:
+		return true
+	default:
+		return false
+	}
+}
+
+// killOrRecycle убивает процесс proc вместе с запущенными им процессами, если
+// он выполняет задачу, иначе штатно перезапускает его. Убитый во время задачи
+// процесс перезапускается обработчиком ошибок timedSend. Если proc уже
+// перезапущен, ничего не делает.
+func (wrk *Worker) killOrRecycle(proc *process, reason string) {
+	if wrk.State() != WorkerBusy {
+		wrk.requestRecycle(reason)
+		return
+	}
+	wrk.life.Lock()
+	defer wrk.life.Unlock()
+	if wrk.proc != proc {
+		return
+	}
+	log.Printf("PID %d: killing worker (%s)", proc.pid, reason)
+	if err := proc.kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		log.Printf("PID %d: kill error: %s", proc.pid, err)
+	}
+}
+
+// recycle штатно останавливает процесс через Stop и запускает вместо него
+// новый. Вызывается между задачами, поэтому текущая задача всегда
+// дорабатывает до конца.
+func (wrk *Worker) recycle(reason string) {
+	wrk.life.Lock()
+	defer wrk.life.Unlock()
+	if wrk.proc == nil {
+		return
+	}
+	pid := wrk.proc.pid
+	if wrk.external {
+		// Внешний процесс перезапускает его собственный супервизор,
+		// после чего он подключается заново.
+		log.Printf("PID %d: disconnecting external worker (%s)", pid, reason)
+		if err := wrk.stop(); err != nil {
+			log.Printf("PID %d: stop error: %s", pid, err)
+		}
+		return
+	}
+	log.Printf(
+		"PID %d: recycling worker (%s) after %d jobs and %s of uptime",
+		pid, reason, wrk.jobs, wrk.uptime(),
+	)
+	if err := wrk.stop(); err != nil {
+		log.Printf("PID %d: stop error: %s", pid, err)
+		// Процесс не ответил на штатную остановку, добиваем его.
+		if wrk.proc != nil {
+			if err := wrk.kill(); err != nil {
+				log.Printf("PID %d: kill error: %s", pid, err)
+			}
+		}
+	}
+	wrk.mu.Lock()
+	err := wrk.start(wrk.argv, wrk.env)
+	wrk.mu.Unlock()
+	if err != nil {
+		log.Printf("PID %d: could not start replacement: %s", pid, err)
+		wrk.failed()
+		wrk.respawn()
+		return
+	}
+	log.Printf("PID %d: replaced by PID %d", pid, wrk.proc.pid)
+}
+
 // Stop останавливает процесс и закрывает все соответствующие буферы
 // чтения/записи.
 func (wrk *Worker) Stop() error {
+	wrk.life.Lock()
+	defer wrk.life.Unlock()
+	return wrk.stop()
+}
+
+// stop работает как Stop, но вызывается с захваченной блокировкой life.
+func (wrk *Worker) stop() error {
 	wrk.mu.Lock()
 	defer wrk.mu.Unlock()
 
-	if wrk.cmd == nil {
-		return errors.New("Worker is not running")
+	if wrk.proc == nil {
+		return errNotRunning
 	}
+	wrk.setState(WorkerStopping)
 	var err error
-	if _, err := wrk.write.Write([]byte("\n")); err != nil {
-		return err
+	if wrk.mux != nil {
+		err = wrk.mux.writeStop()
+	} else if _, err = wrk.write.Write([]byte("\n")); err == nil {
+		err = wrk.write.Flush()
 	}
-	if err = wrk.write.Flush(); err != nil {
-		return err
-	}
-	if err = wrk.cmd.Wait(); err != nil {
+	if err != nil {
 		return err
 	}
+	// Процесс получит конец ввода после сообщения об остановке, а
+	// внешний процесс только так и узнает об отключении.
+	wrk.proc.conn.Close()
+	// Процесс завершен независимо от кода выхода, поэтому сбрасываем
+	// состояние в любом случае, иначе его нельзя будет запустить повторно.
+	<-wrk.exit.done
+	err = wrk.exit.err
 	wrk.reset()
-	return nil
+	return err
 }
 
 // Wait ждет завершения процесса и закрывает все соответствующие буферы
 // чтения/записи.
 func (wrk *Worker) Wait() error {
-	wrk.mu.Lock()
-	defer wrk.mu.Unlock()
+	wrk.life.Lock()
+	defer wrk.life.Unlock()
 
-	if wrk.cmd == nil {
-		return errors.New("Worker is not running")
-	}
-	if err := wrk.cmd.Wait(); err != nil {
-		return err
+	if wrk.proc == nil {
+		return errNotRunning
 	}
+	<-wrk.exit.done
+	wrk.mu.Lock()
+	defer wrk.mu.Unlock()
 	wrk.reset()
-	return nil
+	return wrk.exit.err
 }
 
-// != nil Kill посылает SIGKILL процессу и закрывает все соответствующие буферы
+// Kill посылает SIGKILL процессу и закрывает все соответствующие буферы
 // чтения/записи.
 func (wrk *Worker) Kill() error {
-	wrk.mu.Lock()
-	defer wrk.mu.Unlock()
+	wrk.life.Lock()
+	defer wrk.life.Unlock()
+	return wrk.kill()
+}
 
-	if wrk.cmd == nil {
-		return errors.New("Worker is not running")
-	}
-	if err := wrk.cmd.Process.Kill(); err != nil {
-		return err
+// kill работает как Kill, но вызывается с захваченной блокировкой life.
+func (wrk *Worker) kill() error {
+	if wrk.proc == nil {
+		return errNotRunning
 	}
-	if _, err := wrk.cmd.Process.Wait(); err != nil {
+	// Процесс мог быть уже убит, например, при превышении
+	// MemoryHardLimit.
+	wrk.setState(WorkerStopping)
+	err := wrk.proc.kill()
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
 		return err
 	}
+	// Убитый процесс освобождает mu, если выполнял задачу.
+	wrk.mu.Lock()
+	defer wrk.mu.Unlock()
+	<-wrk.exit.done
 	wrk.reset()
 	return nil
 }
@@ -274,21 +1616,61 @@ func (wrk *Worker) send(data []byte) ([]byte, error) {
 // Restart перезапускает воркер. Если kill = true, то процессу посылается
 // SIGKILL, иначе ожидается его естественное завершение.
 func (wrk *Worker) Restart(kill bool) error {
-	var err error
-	if wrk.cmd != nil && wrk.cmd.Process != nil {
+	wrk.life.Lock()
+	defer wrk.life.Unlock()
+	return wrk.restart(kill)
+}
+
+// restart работает как Restart, но вызывается с захваченной блокировкой life.
+func (wrk *Worker) restart(kill bool) error {
+	if wrk.proc != nil {
 		if kill {
-			if err = wrk.cmd.Process.Kill(); err != nil {
+			if err := wrk.kill(); err != nil {
 				return err
 			}
+		} else {
+			<-wrk.exit.done
+			if err := wrk.exit.err; err != nil {
+				log.Println("restart wait error:", err)
+			}
+			wrk.mu.Lock()
+			wrk.reset()
+			wrk.mu.Unlock()
+		}
+	}
+	wrk.mu.Lock()
+	defer wrk.mu.Unlock()
+	return wrk.start(wrk.argv, wrk.env)
+}
+
+// restartFailed перезапускает процесс cmd после ошибки или таймаута при
+// выполнении задачи. Если процесс уже перезапущен супервизором, ничего не
+// делает. Если новый процесс не запускается, повторяет попытки с задержкой.
+func (wrk *Worker) restartFailed(proc *process) {
+	wrk.life.Lock()
+	defer wrk.life.Unlock()
+	if wrk.proc != proc {
+		return
+	}
+	if wrk.external {
+		log.Printf("PID %d: disconnecting external worker", proc.pid)
+		if err := wrk.kill(); err != nil {
+			log.Println("disconnect error:", err)
 		}
-		if err = wrk.cmd.Wait(); err != nil {
-			log.Println("restart wait error:", err)
+		return
+	}
+	if wrk.retiring() {
+		// Воркер останавливается, новый процесс не нужен.
+		if err := wrk.kill(); err != nil {
+			log.Println("kill error:", err)
 		}
+		return
+	}
+	if err := wrk.restart(true); err != nil {
+		log.Println("restart error:", err)
+		wrk.failed()
+		wrk.respawn()
 	}
-	argv := wrk.argv
-	env := wrk.env
-	wrk.reset()
-	return wrk.Start(argv, env)
 }
 
 func (wrk *Worker) readMsg() ([]byte, error) {
@@ -296,24 +1678,49 @@ func (wrk *Worker) readMsg() ([]byte, error) {
 		return nil, errors.New("read pipe is not started")
 	}
 	// Считываем длину сообщения.
-	l, err := wrk.read.ReadString('\n')
+	l, err := wrk.read.ReadSlice('\n')
 	if err != nil {
 		return nil, err
 	}
-	ln, err := strconv.Atoi(strings.TrimSuffix(l, "\n"))
+	ln, err := strconv.Atoi(string(l[:len(l)-1]))
 	if err != nil {
 		return nil, err
 	}
-	// Читаем ln байт сообщения частями размером PipeChunkSize.
-	buf := &bytes.Buffer{}
-	for ln > 0 {
-		n, err := io.CopyN(buf, wrk.read, int64(min(ln, PipeChunkSize)))
+	return readBody(wrk.read, ln, wrk.MaxMessageSize)
+}
+
+// readBody читает тело сообщения длиной ln, которая не должна превышать limit
+// (при 0 -- DefaultMaxMessageSize). Небольшие сообщения читаются одним вызовом
+// в буфер точного размера, а большие -- в растущий буфер, чтобы память
+// выделялась только под действительно пришедшие данные.
+func readBody(r io.Reader, ln int, limit int) ([]byte, error) {
+	if limit <= 0 {
+		limit = DefaultMaxMessageSize
+	}
+	if ln < 0 {
+		return nil, fmt.Errorf("invalid message length %d", ln)
+	}
+	if ln > limit {
+		return nil, fmt.Errorf(
+			"%w: %d bytes, limit %d", errMessageTooLarge, ln, limit,
+		)
+	}
+	buf := make([]byte, 0, min(ln, readBodyChunk))
+	for len(buf) < ln {
+		if len(buf) == cap(buf) {
+			// append увеличивает емкость пропорционально размеру.
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := io.ReadFull(r, buf[len(buf):min(cap(buf), ln)])
+		buf = buf[:len(buf)+n]
 		if err != nil {
+			if err == io.EOF && len(buf) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
 			return nil, err
 		}
-		ln -= int(n)
 	}
-	return buf.Bytes(), nil
+	return buf, nil
 }
 
 func (wrk *Worker) writeMsg(data []byte) error {
@@ -321,56 +1728,282 @@ func (wrk *Worker) writeMsg(data []byte) error {
 		return errors.New("write pipe is not started")
 	}
 	// Записываем длину сообщения.
-	dlen := len(data)
-	_, err := wrk.write.WriteString(strconv.Itoa(dlen) + "\n")
+	_, err := wrk.write.Write(appendLen(wrk.write.AvailableBuffer(), len(data)))
 	if err != nil {
 		return err
 	}
-	// Записываем сообщение по частям размером PipeChunkSize.
-	ptr := 0
-	for ptr < dlen {
-		_, err = wrk.write.Write(data[ptr:min(ptr+PipeChunkSize, dlen)])
-		if err != nil {
-			return err
-		}
-		ptr += PipeChunkSize
+	if _, err = wrk.write.Write(data); err != nil {
+		return err
 	}
 	return wrk.write.Flush()
 }
 
+// appendLen добавляет к b строку с длиной сообщения ln.
+func appendLen(b []byte, ln int) []byte {
+	return append(strconv.AppendInt(b, int64(ln), 10), '\n')
+}
+
 func (wrk *Worker) reset() {
-	wrk.cmd = nil
+	wrk.setState(WorkerStopped)
+	wrk.mux = nil
+	wrk.started.Store(0)
+	wrk.pid.Store(0)
+	wrk.proc = nil
+	wrk.running.Store(nil)
 	wrk.write = nil
 	wrk.read = nil
 }
 
-func (wrk *Worker) timedSend(data []byte, timeout time.Duration) *WorkerResult {
-	ch := make(chan *WorkerResult)
+func (wrk *Worker) timedSend(
+	ctx context.Context,
+	data []byte,
+	timeout time.Duration,
+	onChunk func([]byte) error,
+) *WorkerResult {
+	// Буфер нужен, чтобы горутина не зависла, если ответ уже не ждут.
+	ch := make(chan *WorkerResult, 1)
 	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	wrk.life.Lock()
+	proc := wrk.proc
+	mux := wrk.mux
+	wrk.life.Unlock()
+	pid := wrk.Pid()
+	if mux != nil {
+		return wrk.muxSend(ctx, mux, proc, data, timer, timeout, onChunk)
+	}
 	go func() {
 		res, err := wrk.send(data)
 		ch <- &WorkerResult{Res: res, Err: err}
 	}()
 
-	select {
-	// Ответ пришел до таймаута.
-	case res := <-ch:
-		timer.Stop()
-		if res.Err != nil {
-			wrk.Restart(true)
+	cancelled := ctx.Done()
+	// Процесс получил TimeoutSignal и доживает отсрочку.
+	soft := false
+	for {
+		select {
+		// Ответ пришел до таймаута.
+		case res := <-ch:
+			if soft {
+				return wrk.softTimedOut(proc, res, timeout)
+			}
+			if res.Err != nil {
+				wrk.jobErrors.Add(1)
+				wrk.restartFailed(proc)
+			}
+			return res
+		// Таймаут.
+		case <-timer.C:
+			if !soft && wrk.signalTimeout(proc, timeout) {
+				soft = true
+				timer.Reset(wrk.TimeoutGrace)
+				continue
+			}
+			return wrk.hardTimedOut(proc, timeout, soft)
+		// Задача отменена во время выполнения.
+		case <-cancelled:
+			if wrk.CancelPolicy != CancelKill {
+				// Дожидаемся ответа, чтобы не ломать процесс, но
+				// больше не следим за контекстом.
+				cancelled = nil
+				continue
+			}
+			log.Printf("PID %d: killing worker (job cancelled)", pid)
+			wrk.restartFailed(proc)
+			return &WorkerResult{
+				nil,
+				fmt.Errorf("%w: PID %d killed", ctx.Err(), pid),
+			}
 		}
+	}
+}
+
+// signalTimeout отправляет процессу proc, не выполнившему задачу за timeout,
+// TimeoutSignal. Возвращает false, если отсрочка не задана или сигнал не
+// удалось отправить, и процесс нужно убить сразу.
+func (wrk *Worker) signalTimeout(proc *process, timeout time.Duration) bool {
+	if wrk.TimeoutGrace <= 0 || proc.cmd == nil {
+		return false
+	}
+	sig := wrk.TimeoutSignal
+	if sig == nil {
+		sig = syscall.SIGTERM
+	}
+	if err := proc.cmd.Process.Signal(sig); err != nil {
+		log.Printf("PID %d: could not send %s: %s", proc.pid, sig, err)
+		return false
+	}
+	log.Printf(
+		"PID %d: job timed out after %s, sent signal %q, killing in %s",
+		proc.pid, timeout, sig, wrk.TimeoutGrace,
+	)
+	return true
+}
+
+// softTimedOut обрабатывает результат res задачи, завершившейся во время
+// отсрочки после TimeoutSignal. Ответ процесса возвращается как есть, а сам
+// процесс штатно перезапускается. Если процесс ответил ошибкой (ErrJobFailed)
+// или завершился, не ответив, то возвращается ErrWorkerTimedOut.
+func (wrk *Worker) softTimedOut(
+	proc *process, res *WorkerResult, timeout time.Duration,
+) *WorkerResult {
+	wrk.timeouts.Add(1)
+	if res.Err == nil {
+		log.Printf("PID %d: job ended by worker after timeout signal", proc.pid)
+		wrk.requestRecycle("timed out")
 		return res
-	// Таймаут.
-	case <-timer.C:
-		wrk.Restart(true)
+	}
+	if errors.Is(res.Err, ErrJobFailed) {
+		log.Printf(
+			"PID %d: job ended by worker error after timeout signal: %s",
+			proc.pid, res.Err,
+		)
+		wrk.requestRecycle("timed out")
 		return &WorkerResult{
 			nil,
 			fmt.Errorf(
-				"%w: PID %d, after %s",
+				"%w: PID %d, after %s, %s",
 				ErrWorkerTimedOut,
-				wrk.cmd.Process.Pid,
+				proc.pid,
 				timeout,
+				res.Err,
 			),
 		}
 	}
+	log.Printf("PID %d: job ended by worker exit after timeout signal", proc.pid)
+	wrk.restartFailed(proc)
+	return &WorkerResult{
+		nil,
+		fmt.Errorf(
+			"%w: PID %d, after %s, exited on signal",
+			ErrWorkerTimedOut,
+			proc.pid,
+			timeout,
+		),
+	}
+}
+
+// hardTimedOut убивает процесс proc, не выполнивший задачу за timeout, и
+// возвращает ErrWorkerTimedOut. soft сообщает, что процесс уже получил
+// TimeoutSignal и не уложился в отсрочку.
+func (wrk *Worker) hardTimedOut(
+	proc *process, timeout time.Duration, soft bool,
+) *WorkerResult {
+	wrk.timeouts.Add(1)
+	stage := "after " + timeout.String()
+	if soft {
+		stage += " and " + wrk.TimeoutGrace.String() + " grace period"
+	}
+	log.Printf("PID %d: job ended by kill %s", proc.pid, stage)
+	wrk.restartFailed(proc)
+	return &WorkerResult{
+		nil,
+		fmt.Errorf("%w: PID %d, %s", ErrWorkerTimedOut, proc.pid, stage),
+	}
+}
+
+// muxSend отправляет данные процессу в режиме мультиплексирования или по
+// протоколу версии 2. Если процесс выполняет несколько задач одновременно,
+// таймаут и отмена задачи не перезапускают его: ответ на такую задачу просто
+// перестает ожидаться. Процесс, выполняющий одну задачу за раз, ведет себя
+// как в обычном режиме.
+//
+// Если onChunk != nil, то он вызывается для каждой части потокового ответа,
+// а таймаут отсчитывается заново после каждой части.
+func (wrk *Worker) muxSend(
+	ctx context.Context,
+	mux *muxConn,
+	proc *process,
+	data []byte,
+	timer *time.Timer,
+	timeout time.Duration,
+	onChunk func([]byte) error,
+) *WorkerResult {
+	pid := proc.pid
+	single := wrk.conc.Load() == 1
+	req, err := mux.send(data, onChunk != nil)
+	if err != nil {
+		log.Println("write error:", err)
+		wrk.jobErrors.Add(1)
+		wrk.restartFailed(proc)
+		return &WorkerResult{Err: err}
+	}
+	// Передает получателю часть ответа. Если получатель не смог ее
+	// принять, например, клиент отключился, то остальные части
+	// отбрасываются.
+	chunk := func(data []byte) {
+		if onChunk == nil {
+			return
+		}
+		if err := onChunk(data); err != nil {
+			onChunk = nil
+		}
+	}
+	cancelled := ctx.Done()
+	soft := false
+	for {
+		select {
+		case res := <-req.res:
+			// Все части ответа отправлены в канал раньше
+			// окончательного ответа.
+			for len(req.chunks) > 0 {
+				chunk(<-req.chunks)
+			}
+			if soft {
+				return wrk.softTimedOut(proc, res, timeout)
+			}
+			if res.Err != nil {
+				wrk.jobErrors.Add(1)
+				if !errors.Is(res.Err, ErrJobFailed) {
+					wrk.restartFailed(proc)
+				}
+			}
+			return res
+		case data := <-req.chunks:
+			chunk(data)
+			// Части ответа не продлевают отсрочку.
+			if soft {
+				continue
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+		case <-timer.C:
+			if single && !soft && wrk.signalTimeout(proc, timeout) {
+				soft = true
+				timer.Reset(wrk.TimeoutGrace)
+				continue
+			}
+			mux.forget(req)
+			if single {
+				return wrk.hardTimedOut(proc, timeout, soft)
+			}
+			wrk.timeouts.Add(1)
+			return &WorkerResult{
+				nil,
+				fmt.Errorf(
+					"%w: PID %d, request %d, after %s",
+					ErrWorkerTimedOut,
+					pid,
+					req.id,
+					timeout,
+				),
+			}
+		case <-cancelled:
+			if single && wrk.CancelPolicy != CancelKill {
+				cancelled = nil
+				continue
+			}
+			mux.forget(req)
+			if single {
+				log.Printf("PID %d: killing worker (job cancelled)", pid)
+				wrk.restartFailed(proc)
+			}
+			return &WorkerResult{
+				nil,
+				fmt.Errorf("%w: PID %d, request %d", ctx.Err(), pid, req.id),
+			}
+		}
+	}
 }
@@ -0,0 +1,118 @@
+package corerunner
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQueueTimeout(t *testing.T) {
+	for _, lanes := range [][]Lane{nil, {{Name: "default"}}} {
+		p := &Pool{MaxQueue: 2, MaxQueueWait: 20 * time.Millisecond, Lanes: lanes}
+		if err := p.Start(nil, 0, nil); err != nil {
+			t.Fatalf("could not start pool: %s", err)
+		}
+		// Задачи, получившие ErrQueueTimeout, остаются в канале очереди,
+		// но не должны ее заполнять.
+		for i := 0; i < 3; i++ {
+			a, b := p.Send(nil, time.Second), p.Send(nil, time.Second)
+			if res := <-p.Send(nil, time.Second); res.Err != ErrQueueFull {
+				t.Fatalf("job beyond MaxQueue got %v", res.Err)
+			}
+			for _, res := range []chan WorkerResult{a, b} {
+				if r := <-res; r.Err != ErrQueueTimeout {
+					t.Fatalf("queued job got %v on round %d", r.Err, i)
+				}
+			}
+			if n := p.queueLength(); n != 0 {
+				t.Fatalf("timed out jobs are counted in queue length %d", n)
+			}
+		}
+		p.Stop()
+	}
+}
+
+func TestQueuedJobCancel(t *testing.T) {
+	// Без MaxQueue у пула без воркеров очередь без буфера, и отправка
+	// ждет воркер, с MaxQueue задача ждет в очереди.
+	for _, maxQueue := range []int{0, 1} {
+		p := &Pool{MaxQueue: maxQueue}
+		if err := p.Start(nil, 0, nil); err != nil {
+			t.Fatalf("could not start pool: %s", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		res := p.SendContext(ctx, nil, time.Second)
+		select {
+		case r := <-res:
+			if r.Err != context.Canceled {
+				t.Fatalf("cancelled job got %v", r.Err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("cancelled job waits for worker with MaxQueue %d", maxQueue)
+		}
+		if n := p.queueLength(); n != 0 {
+			t.Fatalf("cancelled job is counted in queue length %d", n)
+		}
+		if maxQueue > 0 {
+			// Место отмененной задачи свободно.
+			p.Send(nil, time.Second)
+			if r := <-p.Send(nil, time.Second); r.Err != ErrQueueFull {
+				t.Fatalf("job beyond MaxQueue got %v", r.Err)
+			}
+		}
+		p.Stop()
+	}
+}
+
+func TestMinWorkersAboveMax(t *testing.T) {
+	p := &Pool{MinWorkers: 4, MaxWorkers: 2}
+	if err := p.Start(nil, 1, nil); err == nil {
+		p.Stop()
+		t.Fatal("pool with MinWorkers greater than MaxWorkers is started")
+	}
+}
+
+func TestShutdownWithoutWorkers(t *testing.T) {
+	p := &Pool{MaxQueue: 2}
+	if err := p.Start(nil, 0, nil); err != nil {
+		t.Fatalf("could not start pool: %s", err)
+	}
+	res := p.Send(nil, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("pool without workers is not shut down: %s", err)
+	}
+	select {
+	case r := <-res:
+		if r.Err != ErrPoolStopped {
+			t.Fatalf("queued job got %v", r.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued job is not answered")
+	}
+}
+
+func TestIdleMaxUptime(t *testing.T) {
+	p := &Pool{MaxUptime: 50 * time.Millisecond}
+	if err := p.Start(nil, 0, nil); err != nil {
+		t.Fatalf("could not start pool: %s", err)
+	}
+	defer p.Stop()
+	srv, cli := net.Pipe()
+	go func() {
+		io.WriteString(cli, "ok\n")
+		io.Copy(io.Discard, cli)
+	}()
+	p.attach(srv)
+	// Внешний воркер при перезапуске отключается.
+	for i := 0; len(p.externalWorkers()) > 0; i++ {
+		if i == 100 {
+			t.Fatal("idle worker is not recycled after MaxUptime")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}